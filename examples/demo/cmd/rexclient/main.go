@@ -109,7 +109,7 @@ func main() {
 			if err != nil {
 				log.Printf("[ERR] Failed to create a session: %v", err)
 			}
-			defer client.Send(ctx, room.String("DISCONNECT"))
+			defer client.Leave(ctx)
 
 			clientShutdown := make(chan struct{})
 			mdone := make(chan struct{})
@@ -131,7 +131,11 @@ func main() {
 				}
 			}()
 
-			next, err := client.Run(ctx, 0)
+			next, err := client.RunSupervised(ctx, -1, &room.ReconnectConfig{
+				OnState: func(state room.ConnState, err error) {
+					log.Printf("[INFO] Connection %v (%v)", state, err)
+				},
+			})
 			if err != nil {
 				log.Printf("[ERR] Event loop at index %d: %v", next, err)
 				panic(err)
@@ -196,11 +200,15 @@ func main() {
 						touchTime = time.Now()
 						_x := float64(touchX) / float64(sz.WidthPx)
 						_y := float64(touchY) / float64(sz.HeightPx)
-						pt := fmt.Sprintf("%g,%g", _x, _y)
-						select {
-						case messages <- room.String(pt):
-							log.Printf("[INFO] Touch event sent")
-						default:
+						pt, err := rexdemo.Types.Encode(rexdemo.Pt(_x, _y))
+						if err != nil {
+							log.Printf("[ERR] %v", err)
+						} else {
+							select {
+							case messages <- pt:
+								log.Printf("[INFO] Touch event sent")
+							default:
+							}
 						}
 					}
 				}
@@ -220,18 +228,35 @@ func NewDemo() *DemoClient {
 	return (*DemoClient)(rexdemo.NewDemo())
 }
 
+// HandleSnapshot initializes the demo with the state of the server.
+func (c *DemoClient) HandleSnapshot(ctx context.Context, rc *room.Client, snap *room.Snapshot) {
+	c.update(snap)
+}
+
 // HandleEvent processes events broadcast from the server.
 func (c *DemoClient) HandleEvent(ctx context.Context, rc *room.Client, ev room.Event) {
 	log.Printf("[INFO] HANDLING")
-	c.Mut.Lock()
-	defer c.Mut.Unlock()
+	c.update(ev)
+	log.Printf("[INFO] Event: %s", ev.Data())
+}
 
-	_c := DemoClient{Mut: c.Mut}
-	err := json.Unmarshal([]byte(ev.Data()), &_c)
+func (c *DemoClient) update(content room.Content) {
+	v, err := rexdemo.Types.Decode(content)
 	if err != nil {
-		log.Printf("[ERR] Malformed event data from server: %q", ev.Data())
+		log.Printf("[ERR] Malformed state data from server: %v", err)
 		return
 	}
+	state, ok := v.(*rexdemo.Demo)
+	if !ok {
+		log.Printf("[ERR] Unexpected content from server: %T", v)
+		return
+	}
+
+	c.Mut.Lock()
+	defer c.Mut.Unlock()
+
+	_c := DemoClient(*state)
+	_c.Mut = c.Mut
 	*c = _c
 
 	// try to update the local touch data... don't try too hard
@@ -241,8 +266,6 @@ func (c *DemoClient) HandleEvent(ctx context.Context, rc *room.Client, ev room.E
 	case remotePt <- pt:
 	default:
 	}
-
-	log.Printf("[INFO] Event: %s", ev.Data())
 }
 
 // State returns the current demo state of the demo.
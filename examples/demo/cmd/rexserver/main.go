@@ -2,13 +2,12 @@ package main
 
 import (
 	"encoding/binary"
-	"encoding/json"
-	"fmt"
 	"image"
 	_color "image/color"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
 	"time"
 
@@ -229,7 +228,9 @@ func RunDiscovery(background context.Context, demo *DemoServer) {
 	}
 
 	log.Printf("[INFO] demo server initializing")
-	bus := room.NewBus(background, demo)
+	bus := room.NewBus(background, &demoHandler{demo, demo.Router()})
+	bus.Use(room.Recover())
+	bus.SetSnapshotter(demo)
 	config := &room.ServerConfig{
 		Room: rexdemo.Room,
 		Bus:  bus,
@@ -257,7 +258,21 @@ func RunDiscovery(background context.Context, demo *DemoServer) {
 		log.Printf("[FATAL] Discovery server failed to start: %v", err)
 		return
 	}
-	defer disco.Close()
+	server.SetDiscovery(disco)
+
+	// close the room gracefully on interrupt so clients are told it closed.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Printf("[INFO] shutting down")
+		ctx, cancel := context.WithTimeout(background, 5*time.Second)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("[ERR] %v", err)
+		}
+	}()
 
 	err = server.Wait()
 	if err != nil {
@@ -266,6 +281,18 @@ func RunDiscovery(background context.Context, demo *DemoServer) {
 	}
 }
 
+// demoHandler handles messages from demo clients using a room.Router, and
+// presence changes using the DemoServer.
+type demoHandler struct {
+	*DemoServer
+	router *room.Router
+}
+
+// HandleMessage implements room.Handler.
+func (h *demoHandler) HandleMessage(ctx context.Context, msg room.Msg) {
+	h.router.HandleMessage(ctx, msg)
+}
+
 // DemoServer is the server side (source of truth) of the demo object.
 type DemoServer rexdemo.Demo
 
@@ -279,39 +306,73 @@ func (d *DemoServer) State() *rexdemo.Demo {
 	return (*rexdemo.Demo)(d).State()
 }
 
-// HandleMessage adds to the message counter
-func (d *DemoServer) HandleMessage(ctx context.Context, msg room.Msg) {
-	var okpt bool
-	var x, y float64
-	data := msg.Text()
-	_, err := fmt.Sscanf(data, "%g,%g", &x, &y)
-	if err == nil {
-		log.Printf("[INFO] Got a point [%0.03g,%0.03g]", x, y)
-		okpt = true
+// Snapshot implements room.Snapshotter so that clients joining late receive
+// the current demo state.
+func (d *DemoServer) Snapshot(ctx context.Context) (room.Content, error) {
+	d.Mut.Lock()
+	defer d.Mut.Unlock()
+	return rexdemo.Types.Encode(d.State())
+}
+
+// HandlePresence logs sessions joining and leaving the demo.
+func (d *DemoServer) HandlePresence(ctx context.Context, change room.PresenceChange) {
+	log.Printf("[INFO] session %v %v", change.Session, change.Kind)
+}
+
+// Router returns a room.Router which dispatches the messages of demo clients
+// by their type.
+func (d *DemoServer) Router() *room.Router {
+	router := room.NewRouter(nil)
+	router.Handle("point", rexdemo.Types.Handler(d.HandlePoint))
+	router.Fallback(d)
+	return router
+}
+
+// HandlePoint moves the demo point to a point touched by a client.
+func (d *DemoServer) HandlePoint(ctx context.Context, msg room.Msg, v interface{}) {
+	pt, ok := v.(rexdemo.RemotePoint)
+	if !ok {
+		log.Printf("[ERR] Unexpected point %T", v)
+		return
 	}
+	log.Printf("[INFO] Got a point [%0.03g,%0.03g]", pt.X, pt.Y)
 
 	d.Mut.Lock()
 	defer d.Mut.Unlock()
+	d.X = pt.X
+	d.Y = pt.Y
+	// TODO: more resilient transfer of state.
+	select {
+	case remotePt <- pt:
+		log.Printf("[INFO] Sent point [%0.03g,%0.03g]", pt.X, pt.Y)
+	default:
+	}
+	d.countLocked(ctx, msg)
+}
+
+// HandleMessage adds to the message counter.  It handles messages of types
+// not known by the demo.
+func (d *DemoServer) HandleMessage(ctx context.Context, msg room.Msg) {
+	d.Mut.Lock()
+	defer d.Mut.Unlock()
+	d.countLocked(ctx, msg)
+}
+
+// countLocked adds msg to the message counter and broadcasts the new state.
+// The caller must hold d.Mut.
+func (d *DemoServer) countLocked(ctx context.Context, msg room.Msg) {
 	d.Counter++
 	d.Last = time.Now()
-	if okpt {
-		d.X = x
-		d.Y = y
-		pt := rexdemo.Pt(x, y)
-		// TODO: more resilient transfer of state.
-		select {
-		case remotePt <- pt:
-			log.Printf("[INFO] Sent point [%0.03g,%0.03g]", x, y)
-		default:
-		}
-	}
-	log.Printf("[DEBUG] %v session %v %q", msg.Time(), msg.Session(), data)
+	log.Printf("[DEBUG] %v session %v %q", msg.Time(), msg.Session(), msg.Text())
 	log.Printf("[INFO] count: %d", d.Counter)
 
-	js, _ := json.Marshal(d)
+	content, err := rexdemo.Types.Encode(d.State())
+	if err != nil {
+		log.Printf("[ERR] %v", err)
+		return
+	}
 
 	go func() {
-		content := room.Bytes(js)
 		err := room.Broadcast(ctx, content)
 		if err != nil {
 			log.Printf("[ERR] %v", err)
@@ -23,6 +23,21 @@ var Room = &room.Room{
 	Service: "_rexdemo._tcp.",
 }
 
+// Types are the types of content exchanged by clients and servers for the
+// demo.
+var Types = room.NewTypeRegistry(room.JSON)
+
+func init() {
+	err := Types.Register("state", &Demo{})
+	if err != nil {
+		panic(err)
+	}
+	err = Types.Register("point", RemotePoint{})
+	if err != nil {
+		panic(err)
+	}
+}
+
 // RemotePoint is a touch event from another client
 type RemotePoint struct {
 	X float64
@@ -0,0 +1,282 @@
+package room
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JoinPolicy restricts which clients may join a room.  Typically the server
+// application displays the join code on screen so that only people in the
+// room can join.
+type JoinPolicy struct {
+	// Code is the code clients must present to join.  If empty a random code
+	// of CodeLength digits is generated.
+	Code string
+
+	// CodeLength is the number of digits in a generated code.  If zero a
+	// code of four digits is generated.
+	CodeLength int
+}
+
+// NewJoinCode returns a random numeric code with n digits.
+func NewJoinCode(n int) (string, error) {
+	code := make([]byte, n)
+	for i := range code {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code[i] = byte('0' + d.Int64())
+	}
+	return string(code), nil
+}
+
+// The number of invalid join codes a host may present within
+// joinFailureWindow before its attempts are rejected.
+const (
+	joinFailureLimit  = 5
+	joinFailureWindow = time.Minute
+)
+
+// joinAuth issues session tokens to clients and validates the tokens on later
+// requests.  If code is not empty clients must present it to obtain a token
+// and every request must present a token.  Otherwise any client may obtain a
+// token, which is only required to receive private events.  A nil *joinAuth
+// permits all requests and issues no tokens.
+type joinAuth struct {
+	code     string
+	mut      sync.Mutex
+	tokens   map[string]string // session by token
+	issued   map[string]bool   // sessions which have been issued a token
+	failures map[string][]time.Time
+}
+
+func newJoinAuth(policy *JoinPolicy) (*joinAuth, error) {
+	a := &joinAuth{
+		tokens:   make(map[string]string),
+		issued:   make(map[string]bool),
+		failures: make(map[string][]time.Time),
+	}
+	if policy == nil {
+		return a, nil
+	}
+	a.code = policy.Code
+	if a.code == "" {
+		n := policy.CodeLength
+		if n <= 0 {
+			n = 4
+		}
+		var err error
+		a.code, err = NewJoinCode(n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// required returns true if every request must present a token.
+func (a *joinAuth) required() bool {
+	return a != nil && a.code != ""
+}
+
+// errJoinCode is returned when a client presents an invalid join code.
+var errJoinCode = errors.New("invalid join code")
+
+// errJoinThrottled is returned when a host has presented too many invalid join
+// codes.
+var errJoinThrottled = errors.New("too many invalid join codes")
+
+// errSessionTaken is returned when a token is requested for a session which
+// was already issued one.
+var errSessionTaken = errors.New("a token was already issued for the session")
+
+// join issues a token for session if code is correct.  Hosts presenting too
+// many invalid codes are temporarily refused.  Each session is issued only one
+// token, so no other client can obtain a token for a session in use.
+func (a *joinAuth) join(host, session, code string) (token string, err error) {
+	if a == nil {
+		return "", nil
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range a.failures[host] {
+		if now.Sub(t) < joinFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	a.failures[host] = recent
+	if len(recent) >= joinFailureLimit {
+		return "", errJoinThrottled
+	}
+	if a.code != "" && subtle.ConstantTimeCompare([]byte(code), []byte(a.code)) != 1 {
+		a.failures[host] = append(recent, now)
+		return "", errJoinCode
+	}
+	delete(a.failures, host)
+	if a.issued[session] {
+		return "", errSessionTaken
+	}
+
+	var buf [16]byte
+	_, err = rand.Read(buf[:])
+	if err != nil {
+		return "", err
+	}
+	token = hex.EncodeToString(buf[:])
+	a.tokens[token] = session
+	a.issued[session] = true
+	return token, nil
+}
+
+// revoke invalidates the token issued for session.  A nil *joinAuth ignores
+// revoke.
+func (a *joinAuth) revoke(session string) {
+	if a == nil {
+		return
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	if !a.issued[session] {
+		return
+	}
+	for token, tsession := range a.tokens {
+		if tsession == session {
+			delete(a.tokens, token)
+		}
+	}
+	delete(a.issued, session)
+}
+
+// session returns the session authorized by the token presented in r.  The
+// token may be given as a bearer token in the Authorization header or, for
+// clients unable to set headers, as the token query parameter.  If tokens
+// are not required session returns true and an empty session for requests
+// without a valid token.
+func (a *joinAuth) session(r *http.Request) (session string, ok bool) {
+	if a == nil {
+		return "", true
+	}
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	session, ok = a.tokens[token]
+	if !ok && a.code == "" {
+		return "", true
+	}
+	return session, ok
+}
+
+// owns returns true if r presents a token issued for session.
+func (a *joinAuth) owns(r *http.Request, session string) bool {
+	tsession, _ := a.session(r)
+	return session != "" && tsession == session
+}
+
+// authorize writes an error response and returns false if r does not present
+// a valid token.  If session is not empty the token must have been issued for
+// that session.
+func (a *joinAuth) authorize(w http.ResponseWriter, r *http.Request, session string) bool {
+	tsession, ok := a.session(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, jsonError("session_unauthorized", "a valid session token is required"))
+		return false
+	}
+	if a.required() && session != "" && session != tsession {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, jsonError("session_forbidden", "the session token was issued for a different session"))
+		return false
+	}
+	return true
+}
+
+// remoteHost returns the host portion of the remote address of r.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func busJoinHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("POST"))
+			return
+		}
+
+		var req struct {
+			Session string `json:"session"`
+			Code    string `json:"code"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("http_request_invalid", "could not read a complete entity"))
+			return
+		}
+		if req.Session == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("protocol_error", "missing session"))
+			return
+		}
+
+		if !admit(b, w, r, req.Session) {
+			return
+		}
+		token, err := auth.join(remoteHost(r), req.Session, req.Code)
+		if err != nil {
+			writeJoinError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&jsonJoin{Session: req.Session, Token: token})
+	}
+}
+
+// writeJoinError writes the response for an error returned by joinAuth.join.
+func writeJoinError(w http.ResponseWriter, err error) {
+	switch err {
+	case errJoinCode:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, jsonError("join_code_invalid", err.Error()))
+	case errJoinThrottled:
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, jsonError("join_throttled", err.Error()))
+	case errSessionTaken:
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintln(w, jsonError("session_taken", err.Error()))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, jsonError("join_error", "unable to issue a session token"))
+	}
+}
+
+// jsonJoin is the response to a successful join request.  Token is empty if
+// the server does not issue session tokens.
+type jsonJoin struct {
+	Session string `json:"session"`
+	Token   string `json:"token,omitempty"`
+}
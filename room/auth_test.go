@@ -0,0 +1,115 @@
+package room
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestNewJoinCode(t *testing.T) {
+	code, err := NewJoinCode(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 6 {
+		t.Errorf("code: %q", code)
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			t.Errorf("code: %q", code)
+		}
+	}
+}
+
+func TestJoinAuth(t *testing.T) {
+	msgs := make(chan Msg, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		msgs <- msg
+	}))
+	defer b.close()
+
+	auth, err := newJoinAuth(&JoinPolicy{Code: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(newHTTPBus(b, auth, nil))
+	defer s.Close()
+
+	resp, err := http.Post(s.URL+"/rex/v0/messages", "application/json", strings.NewReader(`{
+		"session": "session-01",
+		"time": "0000010000000001",
+		"data": "test content"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("message without token: %s", resp.Status)
+	}
+
+	c := testClient(t, s, nil)
+	c.JoinCode = "4321"
+	err = c.CreateSession(context.Background(), "player")
+	if err == nil {
+		t.Errorf("created session with an invalid code")
+	}
+	if c.Session != "" || c.Token != "" {
+		t.Errorf("session: %q token: %q", c.Session, c.Token)
+	}
+
+	c.JoinCode = "1234"
+	err = c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Token == "" {
+		t.Errorf("no token issued")
+	}
+	err = c.Send(context.Background(), String("test content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgs:
+		if msg.Session() != c.Session {
+			t.Errorf("session: %q (!= %q)", msg.Session(), c.Session)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+
+	// A token only authorizes the session it was issued for.
+	other := testClient(t, s, nil)
+	other.Session = "session-01"
+	other.Token = c.Token
+	err = other.Send(context.Background(), String("test content"))
+	if err == nil {
+		t.Errorf("sent message for another session")
+	}
+}
+
+func TestJoinAuthThrottled(t *testing.T) {
+	auth, err := newJoinAuth(&JoinPolicy{Code: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < joinFailureLimit; i++ {
+		_, err := auth.join("host", "session", "0000")
+		if err != errJoinCode {
+			t.Fatalf("join %d: %v", i, err)
+		}
+	}
+	_, err = auth.join("host", "session", "1234")
+	if err != errJoinThrottled {
+		t.Errorf("join: %v", err)
+	}
+	_, err = auth.join("otherhost", "session", "1234")
+	if err != nil {
+		t.Errorf("join: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package room
 
 import (
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
@@ -26,148 +27,452 @@ func (fn handlerFunc) HandleMessage(ctx context.Context, msg Msg) {
 
 // Bus is the communication bus for a Server.
 type Bus struct {
-	ctx  context.Context
-	term chan struct{}
+	ctx       context.Context
+	term      chan struct{}
+	closed    chan struct{} // closed once the event stores are closed
+	closeOnce sync.Once
+	pending   *drain // messages sent and not yet handled
+	clock     Clock
 
-	hmut     sync.RWMutex
-	handlers []Handler
+	hmut       sync.RWMutex // held for reading while handlers run
+	regmut     sync.Mutex
+	handlers   []*Registration // replaced, never modified
+	middleware []Middleware
+	handler    Handler // handlers wrapped with middleware
+	recovers   bool    // middleware includes Recover
 
-	sub       chan chan<- int
-	eventsin  chan Event
-	events    []Event // The history of events
-	eventsrdy *sync.Cond
-	msgs      chan Msg
+	logs       map[string]*eventLog // The retained history of events by topic
+	private    map[string]*eventLog // The retained private events by session
+	seq        uint64               // The number of events appended to all logs
+	eventsrdy  *sync.Cond
+	retention  Retention
+	topicStore func(topic string) (EventStore, error)
+	msgs       chan *envelope
+	workers    *dispatcher // message queues by session, if concurrent
+	dedup      *dedupWindow
+	sessions   *SessionRegistry
+	presence   *presenceTracker
+	bans       *banList
+	subs       map[string]map[*Subscription]struct{} // open subscriptions by session
+	onKick     []func(session string)                // called by Kick, guarded by regmut
+
+	snapmut  sync.Mutex // guards snapper, snapgen and snapshot
+	snapper  Snapshotter
+	snapgen  uint64    // incremented by SetSnapshotter
+	snapshot *Snapshot // The most recent snapshot
+	snapreq  chan chan<- snapshotResult
+}
+
+// BusConfig contains optional parameters for a Bus.  The zero value is the
+// default configuration.
+type BusConfig struct {
+	// Retention limits the size of the event log.  If nil all events are
+	// retained for the lifetime of the Bus.
+	Retention *Retention
+
+	// Store holds the event log for the default topic.  If nil events are
+	// stored in memory.  The Bus takes ownership of the store and closes it
+	// when the Bus terminates.
+	Store EventStore
+
+	// TopicStore opens the store holding the event log for a named topic.
+	// A topic's store is opened when the first event is broadcast on the
+	// topic, so a restarted Bus resumes a topic's log, and delivers its
+	// events to subscriptions, once it broadcasts on the topic again.  As
+	// with Store the Bus takes ownership of the stores.  If nil events on
+	// named topics are stored in memory.  Stores are only opened for topics
+	// the application broadcasts on, never for topics named by clients.
+	// The private events of a session are kept in the store named by
+	// PrivateTopic and the session separated by a slash.
+	TopicStore func(topic string) (EventStore, error)
+
+	// IdleTimeout is how long a session may go without an open
+	// subscription or sending a message before handlers are notified that
+	// it is idle.  If zero DefaultIdleTimeout is used.
+	IdleTimeout time.Duration
+
+	// LeaveTimeout is how long a session may go without an open
+	// subscription or sending a message before it is considered to have
+	// left.  If zero sessions only leave by request.
+	LeaveTimeout time.Duration
+
+	// DedupWindow is the number of message identifiers remembered for each
+	// session in order to discard duplicate messages.  If zero
+	// DefaultDedupWindow is used.  If negative duplicates are not discarded.
+	DedupWindow int
+
+	// Workers is the number of goroutines handling messages.  If zero
+	// messages are handled one at a time.  Otherwise messages from
+	// different sessions are handled concurrently, so handlers must be
+	// safe for concurrent use, while messages from each session are still
+	// handled in order.  Each session has its own queue, so a slow handler
+	// only delays the session whose message it is handling.  Snapshots are
+	// taken while no handlers are running.
+	Workers int
 }
 
 // NewBus initializes and returns a new Bus.
 func NewBus(ctx context.Context, handlers ...Handler) *Bus {
-	b := &Bus{}
+	return NewBusConfig(ctx, nil, handlers...)
+}
+
+// NewBusConfig is like NewBus but allows the Bus to be configured.  A nil
+// config is equivalent to calling NewBus.
+func NewBusConfig(ctx context.Context, config *BusConfig, handlers ...Handler) *Bus {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	b := &Bus{ctx: ctx}
 	b.init()
-	b.handlers = handlers
+	b.handlers = b.registerLocked(handlers)
+	b.chainLocked()
+	if config != nil {
+		if config.Retention != nil {
+			b.retention = *config.Retention
+		}
+		if config.Store != nil {
+			b.logs[""] = newEventLog(config.Store)
+			b.resumeClock(config.Store)
+		}
+		b.topicStore = config.TopicStore
+		b.presence = newPresenceTracker(config.IdleTimeout, config.LeaveTimeout)
+		if config.DedupWindow != 0 {
+			b.dedup = newDedupWindow(config.DedupWindow)
+		}
+		if config.Workers > 0 {
+			b.startWorkers(config.Workers)
+		}
+	}
 	go b.msgLoop()
 	go b.eventLoop()
+	go b.presenceLoop()
 	return b
 }
 
 func (b *Bus) close() {
-	close(b.term)
+	b.closeOnce.Do(func() { close(b.term) })
 }
 
 func (b *Bus) init() {
 	b.term = make(chan struct{})
-	b.sub = make(chan chan<- int)
-	b.eventsin = make(chan Event)
+	b.closed = make(chan struct{})
+	b.pending = newDrain()
+	b.logs = map[string]*eventLog{"": newEventLog(NewMemStore())}
+	b.private = make(map[string]*eventLog)
 	b.eventsrdy = sync.NewCond(&sync.Mutex{})
-	b.msgs = make(chan Msg)
+	b.msgs = make(chan *envelope)
+	b.dedup = newDedupWindow(DefaultDedupWindow)
+	b.snapreq = make(chan chan<- snapshotResult)
+	b.sessions = NewSessionRegistry()
+	b.presence = newPresenceTracker(0, 0)
+	b.bans = newBanList()
+	b.subs = make(map[string]map[*Subscription]struct{})
+}
+
+// Sessions returns the registry of sessions which have joined b.
+func (b *Bus) Sessions() *SessionRegistry {
+	return b.sessions
 }
 
-// Event broadcasts an event to all Subscription.
+// Event broadcasts an event to all Subscription.  The event is in the log when
+// Event returns, so it is reflected in the index of any later Snapshot.  An
+// error is returned if the event could not be written to the bus EventStore.
+// Once b is closed Event returns ErrClosed.
 func (b *Bus) Event(c Content) error {
-	event := newEvent(0, c, dt.Now)
-	b.eventsin <- event
+	return b.appendEvent("", nil, c)
+}
+
+// EventTo is like Event but the event is only delivered to the given
+// sessions, on PrivateTopic.  Each session has its own log of private events
+// so the event is given the next index in the log of each session.  If
+// sessions is empty no event is added to any log.
+func (b *Bus) EventTo(sessions []string, c Content) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	return b.appendEvent(PrivateTopic, sessions, c)
+}
+
+// appendEvent adds an event to the log of topic or, if topic is PrivateTopic,
+// to the private log of each session.
+func (b *Bus) appendEvent(topic string, sessions []string, c Content) error {
+	b.eventsrdy.L.Lock()
+	defer b.eventsrdy.L.Unlock()
+	select {
+	case <-b.term:
+		return ErrClosed
+	default:
+	}
+	if topic != PrivateTopic {
+		sessions = []string{""}
+	}
+	var logs []*eventLog
+	opened := make(map[*eventLog]bool, len(sessions))
+	for _, session := range sessions {
+		elog, err := b.openLogLocked(topic, session)
+		if err != nil {
+			return err
+		}
+		if !opened[elog] {
+			opened[elog] = true
+			logs = append(logs, elog)
+		}
+	}
+	now := b.clock.Now()
+	b.seq++
+	defer b.eventsrdy.Broadcast()
+	for _, elog := range logs {
+		event := newTopicEvent(topic, elog.events.Next(), c, func() Time { return now })
+		event.seq = b.seq
+		err := elog.events.Append(event)
+		if err != nil {
+			return err
+		}
+		elog.at = append(elog.at, time.Now())
+		b.retainLocked(elog)
+	}
 	return nil
 }
 
-// Message is called by a subscriber to signal back to the bus owner via
-// b.handler.
-func (b *Bus) Message(session string, c Content) error {
-	msg := newMsg(session, c, dt.Now)
-	b.msgs <- msg
+// Now returns the current time of the bus clock.  The time is later than
+// that of every message received and event broadcast by b.
+func (b *Bus) Now() Time {
+	return b.clock.Now()
+}
+
+// resumeClock merges the time of the last event in store into the bus clock
+// so that new events are later than those already stored.
+func (b *Bus) resumeClock(store EventStore) {
+	if store.Next() == store.First() {
+		return
+	}
+	events, err := store.Events(store.Next() - 1)
+	if err != nil || len(events) == 0 {
+		return
+	}
+	b.clock.Update(events[0].Time())
+}
+
+// stamp returns a function giving the time of a message which session gave
+// time t.  When the function is called the bus clock is merged with t,
+// translated into the timeline of the bus clock.
+func (b *Bus) stamp(session string, t Time) func() Time {
+	return func() Time {
+		now := b.clock.Update(shift(t, b.sessions.clockOffset(session)))
+		if t.IsZero() {
+			return now
+		}
+		return t
+	}
+}
+
+// checkTime returns ErrTimeAhead if t, the time given to a message by
+// session, is more than MaxClockSkew ahead of the physical time of the bus
+// clock.
+func (b *Bus) checkTime(session string, t Time) error {
+	t = shift(t, b.sessions.clockOffset(session))
+	if t.Wall > b.clock.physical()+int64(MaxClockSkew/time.Millisecond) {
+		return ErrTimeAhead
+	}
 	return nil
 }
 
-// AddHandler changes the bus message handler.
-func (b *Bus) AddHandler(h Handler) {
-	b.hmut.Lock()
-	defer b.hmut.Unlock()
-	b.handlers = append(b.handlers, h)
+// next returns the index that will be assigned to the next event in the
+// default topic.
+func (b *Bus) next() uint64 {
+	b.eventsrdy.L.Lock()
+	defer b.eventsrdy.L.Unlock()
+	return b.logs[""].events.Next()
+}
+
+// Message is called by a subscriber to signal back to the bus owner via
+// b.handler.  Once b begins shutting down Message returns ErrClosed.
+func (b *Bus) Message(session string, c Content) error {
+	return b.MessageOn("", session, c)
 }
 
-func (b *Bus) handle(msg Msg) {
+func (b *Bus) handle(env *envelope) {
+	defer b.pending.release()
+	if env.done != nil {
+		defer close(env.done)
+	}
 	b.hmut.RLock()
 	defer b.hmut.RUnlock()
 	ctx := withBus(b.ctx, b)
-	for _, h := range b.handlers {
-		h.HandleMessage(ctx, msg)
+	h, handlers, recovers := b.current()
+	switch {
+	case env.presence != nil:
+		if recovers {
+			ctx = withRecover(ctx)
+		}
+		presenceHandlers(ctx, handlers, *env.presence)
+		if env.presence.Kind == PresenceLeave {
+			b.forget(env.presence.Session)
+		}
+	case env.call != nil:
+		handleCall(ctx, h, env.msg, env.call)
+	default:
+		h.HandleMessage(withEnvelope(ctx, env), env.msg)
+		if env.err != nil {
+			b.dedup.remove(env.msg.Session(), env.id)
+		}
 	}
 }
 
-// msgLoop dispatches messages passed in with b.Message to b.handler.  Calls to
-// b.handler as serialized.  Concurrency must be handled at a higher level of
-// abstraction.
+// msgLoop dispatches messages passed in with b.Message to b.handler.  Unless
+// the bus has workers, calls to b.handler as serialized.  Concurrency must be
+// handled at a higher level of abstraction.  Snapshots are taken between calls
+// to b.handler so they never observe a partially handled message.
 func (b *Bus) msgLoop() {
 	for {
 		select {
 		case <-b.term:
-			// FIXME notify future callers of b.Message()
 			return
-		case msg := <-b.msgs:
-			b.handle(msg)
+		case env := <-b.msgs:
+			b.dispatch(env)
+		case c := <-b.snapreq:
+			c <- b.takeSnapshot()
 		}
 	}
 }
 
+// eventLoop wakes any subscriptions waiting for events when b terminates and
+// closes the bus EventStores.
 func (b *Bus) eventLoop() {
-	defer b.eventsrdy.Broadcast()
-
-	for {
-		select {
-		case <-b.term:
-			return
-		case event := <-b.eventsin:
-			//log.Printf("event! %v", event.Text())
-			i := uint64(len(b.events))
-			ievent := newEvent(i, event, event.Time)
-			b.eventsrdy.L.Lock()
-			//log.Printf("locked!")
-			b.events = append(b.events, ievent)
-			b.eventsrdy.Broadcast()
-			b.eventsrdy.L.Unlock()
-			//log.Printf("unlocked!")
+	<-b.term
+	defer close(b.closed)
+	b.eventsrdy.L.Lock()
+	defer b.eventsrdy.L.Unlock()
+	b.eventsrdy.Broadcast()
+	for topic, elog := range b.logs {
+		err := elog.events.Close()
+		if err != nil {
+			log.Printf("[ERR] Failed to close event store for topic %q: %v", topic, err)
+		}
+	}
+	for session, elog := range b.private {
+		err := elog.events.Close()
+		if err != nil {
+			log.Printf("[ERR] Failed to close private event store for session %q: %v", session, err)
 		}
 	}
 }
 
-// Subscribe returns a new Subscription that new events from b.
-func (b *Bus) Subscribe(start int) *Subscription {
+// Subscribe returns a new Subscription that new events from b.  If events
+// beginning at start have been compacted the returned Subscription is
+// terminated and its Err method returns a *CompactedError.  The Subscription
+// does not receive events sent to specific sessions with EventTo.
+//
+// If topics are given the Subscription receives events from each of them,
+// beginning at index start in every topic.  Otherwise it receives events from
+// the default topic.
+func (b *Bus) Subscribe(start int, topics ...string) *Subscription {
+	return b.SubscribeAs("", start, topics...)
+}
+
+// SubscribeAs is like Subscribe but the Subscription is made on behalf of
+// session.  If topics include PrivateTopic the Subscription receives the
+// events sent to session with EventTo.
+func (b *Bus) SubscribeAs(session string, start int, topics ...string) *Subscription {
+	if len(topics) == 0 {
+		topics = []string{""}
+	}
+	starts := make(map[string]int, len(topics))
+	for _, topic := range topics {
+		starts[topic] = start
+	}
+	return b.SubscribeTopics(session, starts)
+}
+
+// SubscribeTopics is like SubscribeAs but begins receiving events from each
+// topic in starts at the corresponding index.  Events within a topic are
+// received in index order.  Events from different topics are received in the
+// order they were broadcast.
+func (b *Bus) SubscribeTopics(session string, starts map[string]int) *Subscription {
 	s := &Subscription{
-		term: make(chan struct{}),
-		req:  make(chan chan<- Event),
+		session: session,
+		term:    make(chan struct{}),
+		req:     make(chan chan<- Event),
+		kicked:  make(chan struct{}),
+	}
+	if session != "" && b.bans.isKicked(session) {
+		s.err = ErrSessionKicked
+		close(s.term)
+		return s
+	}
+	b.seen(session, 1)
+	var cursors []*logCursor
+	b.eventsrdy.L.Lock()
+	if session != "" && b.bans.isKicked(session) {
+		// the session was kicked while subscribing.
+		close(s.kicked)
+	} else if session != "" {
+		if b.subs[session] == nil {
+			b.subs[session] = make(map[*Subscription]struct{})
+		}
+		b.subs[session][s] = struct{}{}
+	}
+	for topic, start := range starts {
+		if start < 0 {
+			start = 0
+		}
+		elog := b.logLocked(topic, session)
+		if elog != nil {
+			first := elog.events.First()
+			if uint64(start) < first && s.err == nil {
+				s.err = &CompactedError{Topic: topic, First: first}
+			}
+		}
+		cursors = append(cursors, &logCursor{topic, session, elog, uint64(start)})
 	}
-	go b.fulfill(start, s)
+	b.eventsrdy.L.Unlock()
+	if s.err != nil {
+		close(s.term)
+		return s
+	}
+	go b.fulfill(cursors, s)
 	return s
 }
 
-func (b *Bus) fulfill(start int, s *Subscription) {
+func (b *Bus) fulfill(cursors []*logCursor, s *Subscription) {
 	defer close(s.term)
 
-	i := start
 	for {
 		b.eventsrdy.L.Lock()
-		events := b.events
-		for i >= len(events) {
+		cur, event, err := b.nextEventLocked(cursors)
+		for cur == nil && err == nil {
 			select {
 			case <-b.term:
+				b.eventsrdy.L.Unlock()
+				s.err = ErrClosed
+				return
+			case <-s.kicked:
+				b.eventsrdy.L.Unlock()
+				s.err = ErrSessionKicked
 				return
 			default:
 			}
-			//log.Printf("events: %d", len(events))
 			b.eventsrdy.Wait()
-			events = b.events
+			cur, event, err = b.nextEventLocked(cursors)
 		}
 		b.eventsrdy.L.Unlock()
-		//log.Printf("here we go: %d", len(events))
-		for _, event := range events[i:] {
-			select {
-			case <-b.term:
+		if err != nil {
+			s.err = err
+			return
+		}
+		cur.i++
+		select {
+		case <-b.term:
+			s.err = ErrClosed
+			return
+		case <-s.kicked:
+			s.err = ErrSessionKicked
+			return
+		case c, ok := <-s.req:
+			if !ok {
 				return
-			case c, ok := <-s.req:
-				if !ok {
-					return
-				}
-				c <- event
-				i++
 			}
+			c <- event
 		}
 	}
 }
@@ -176,14 +481,43 @@ func (b *Bus) fulfill(start int, s *Subscription) {
 // returns no further events will be received in calls to s.Next().
 func (b *Bus) Unsubscribe(s *Subscription) {
 	s.close()
+	if s.session == "" {
+		return
+	}
+	b.eventsrdy.L.Lock()
+	_, open := b.subs[s.session][s]
+	delete(b.subs[s.session], s)
+	if len(b.subs[s.session]) == 0 {
+		delete(b.subs, s.session)
+	}
+	b.eventsrdy.L.Unlock()
+	if open {
+		// subscriptions of kicked sessions were already removed.
+		b.seen(s.session, -1)
+	}
 }
 
 // Subscription represents a remote client that needs to receive messages from
 // a Bus.
 type Subscription struct {
-	term  chan struct{}
-	req   chan chan<- Event
-	event Event
+	session string
+	term    chan struct{}
+	req     chan chan<- Event
+	kicked  chan struct{} // closed when the session is kicked
+	event   Event
+	err     error
+}
+
+// Err returns the error which terminated s, if any.  If events requested by s
+// were compacted before they could be delivered Err returns a
+// *CompactedError.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.term:
+		return s.err
+	default:
+		return nil
+	}
 }
 
 // Event returns the last received Event.
@@ -225,6 +559,16 @@ func Broadcast(ctx context.Context, content Content) error {
 	return b.Event(content)
 }
 
+// Unicast sends an event only to the given sessions connected to the Bus
+// associated with ctx.
+func Unicast(ctx context.Context, sessions []string, content Content) error {
+	b := contextBus(ctx)
+	if b == nil {
+		return fmt.Errorf("context has no associated bus")
+	}
+	return b.EventTo(sessions, content)
+}
+
 type busContextKey struct{}
 
 func withBus(ctx context.Context, b *Bus) context.Context {
@@ -80,3 +80,58 @@ func TestBusSubscription(t *testing.T) {
 		t.Errorf("num event: %d", n)
 	}
 }
+
+func TestBusEventTo(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	b.Event(String("broadcast 0"))
+	b.EventTo([]string{"session-01"}, String("private 1"))
+	b.EventTo([]string{"session-02"}, String("private 2"))
+	b.EventTo([]string{"session-01", "session-02", "session-01"}, String("private 3"))
+	b.Event(String("broadcast 1"))
+	if err := b.EventOn(PrivateTopic, String("private 4")); err != ErrPrivateTopic {
+		t.Errorf("broadcast on private topic: %v", err)
+	}
+
+	type ev struct {
+		topic string
+		index uint64
+		text  string
+	}
+	for _, test := range []struct {
+		session string
+		events  []ev
+	}{
+		{"", []ev{
+			{"", 0, "broadcast 0"},
+			{"", 1, "broadcast 1"},
+		}},
+		{"session-01", []ev{
+			{"", 0, "broadcast 0"},
+			{PrivateTopic, 0, "private 1"},
+			{PrivateTopic, 1, "private 3"},
+			{"", 1, "broadcast 1"},
+		}},
+		{"session-02", []ev{
+			{"", 0, "broadcast 0"},
+			{PrivateTopic, 0, "private 2"},
+			{PrivateTopic, 1, "private 3"},
+			{"", 1, "broadcast 1"},
+		}},
+	} {
+		s := b.SubscribeAs(test.session, 0, "", PrivateTopic)
+		for _, e := range test.events {
+			if !s.Next(time.After(time.Second)) {
+				t.Errorf("session %q: no event %q", test.session, e.text)
+				break
+			}
+			event := s.Event()
+			if event.Topic() != e.topic || event.Index() != e.index || event.Text() != e.text {
+				t.Errorf("session %q: event %q %d %q (!= %q %d %q)", test.session,
+					event.Topic(), event.Index(), event.Text(), e.topic, e.index, e.text)
+			}
+		}
+		b.Unsubscribe(s)
+	}
+}
@@ -0,0 +1,446 @@
+package room
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// DefaultCallTimeout is the amount of time a call waits for a reply when no
+// other deadline applies.
+var DefaultCallTimeout = 10 * time.Second
+
+// MaxCallTimeout is the longest time the server waits for a reply to a call,
+// regardless of the timeout requested by the client.
+var MaxCallTimeout = time.Minute
+
+// ErrNoReply is returned by a call when no handler replied to the message.
+var ErrNoReply = errors.New("no handler replied to the call")
+
+// ErrNotCall is returned by Reply when the message being handled is not a
+// call.
+var ErrNotCall = errors.New("message is not a call")
+
+// ErrReplied is returned by Reply when a reply has already been sent.
+var ErrReplied = errors.New("call already replied to")
+
+// CallError is returned by a call when a handler replies with ReplyError.
+type CallError struct {
+	Reason string
+}
+
+func (err *CallError) Error() string {
+	return "call failed: " + err.Reason
+}
+
+type callResult struct {
+	c   Content
+	err error
+}
+
+// call is a message awaiting a reply from handlers.
+type call struct {
+	mut     sync.Mutex
+	replied bool
+	result  chan callResult
+}
+
+func newCall() *call {
+	return &call{result: make(chan callResult, 1)}
+}
+
+func (c *call) reply(content Content, err error) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.replied {
+		return ErrReplied
+	}
+	c.replied = true
+	c.result <- callResult{content, err}
+	return nil
+}
+
+type callContextKey struct{}
+
+func withCall(ctx context.Context, c *call) context.Context {
+	return context.WithValue(ctx, callContextKey{}, c)
+}
+
+func contextCall(ctx context.Context) *call {
+	c, _ := ctx.Value(callContextKey{}).(*call)
+	return c
+}
+
+// Reply sends content to the client which made the call being handled with
+// ctx.  Only the first reply to a call is delivered, later calls return
+// ErrReplied.  If the message being handled is not a call Reply returns
+// ErrNotCall.  Handlers must reply before HandleMessage returns; once every
+// handler has returned the call fails with ErrNoReply.
+func Reply(ctx context.Context, content Content) error {
+	c := contextCall(ctx)
+	if c == nil {
+		return ErrNotCall
+	}
+	return c.reply(content, nil)
+}
+
+// ReplyError is like Reply but the call fails with a *CallError with the
+// reason given by err.
+func ReplyError(ctx context.Context, err error) error {
+	c := contextCall(ctx)
+	if c == nil {
+		return ErrNotCall
+	}
+	return c.reply(nil, &CallError{err.Error()})
+}
+
+// IsCall returns true if the message being handled with ctx is a call
+// awaiting a reply.
+func IsCall(ctx context.Context) bool {
+	return contextCall(ctx) != nil
+}
+
+// Call sends a message to b's handlers like Message and waits for a handler
+// to reply.  If all handlers return without replying Call returns ErrNoReply.
+// If ctx is done before a reply is received Call returns ctx.Err().
+func (b *Bus) Call(ctx context.Context, session string, c Content) (Content, error) {
+	return b.CallOn(ctx, "", session, c)
+}
+
+// CallOn is like Call but the message is sent on the named topic.
+func (b *Bus) CallOn(ctx context.Context, topic string, session string, c Content) (Content, error) {
+	return b.call(ctx, topic, session, c, Time{})
+}
+
+// call is like CallOn but the message was given time t by its sender.
+func (b *Bus) call(ctx context.Context, topic string, session string, c Content, t Time) (Content, error) {
+	if session != "" && b.bans.isKicked(session) {
+		return nil, ErrSessionKicked
+	}
+	err := b.checkTime(session, t)
+	if err != nil {
+		return nil, err
+	}
+	env := &envelope{msg: newTopicMsg(topic, session, c, b.stamp(session, t)), call: newCall()}
+	b.seen(session, 0)
+	err = b.send(ctx, env)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-env.call.result:
+		return r.c, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleCall runs h for msg with a context that allows handlers to reply.  If
+// none of them reply before returning the call fails with ErrNoReply.
+func handleCall(ctx context.Context, h Handler, msg Msg, c *call) {
+	ctx = withCall(ctx, c)
+	h.HandleMessage(ctx, msg)
+	c.reply(nil, ErrNoReply)
+}
+
+// jsonReply is a reply to a call, sent over a WebSocket or as the response to
+// a POST to /rex/v0/calls.  A failed call has an error and reason instead of
+// data.  A call which could not be routed also names the route.
+type jsonReply struct {
+	R      string `json:"reply"`
+	D      string `json:"data,omitempty"`
+	E      string `json:"encoding,omitempty"` // the encoding of D, if any
+	Y      string `json:"type,omitempty"`     // the content type of D, if any
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Route  string `json:"route,omitempty"`
+}
+
+func newJSONReply(request string, c Content, err error) *jsonReply {
+	r := &jsonReply{R: request}
+	switch err := err.(type) {
+	case nil:
+		r.D, r.E = encodeContent(c)
+		r.Y = ContentType(c)
+	case *CallError:
+		r.Error, r.Reason = "call_error", err.Reason
+	case *UnknownRouteError:
+		r.Error, r.Reason, r.Route = "route_unknown", err.Error(), err.Route
+	default:
+		switch err {
+		case ErrNoReply:
+			r.Error = "call_unanswered"
+		case ErrSessionKicked:
+			r.Error = "session_kicked"
+		case ErrClosed:
+			r.Error = "room_closed"
+		case context.DeadlineExceeded:
+			r.Error = "call_timeout"
+		default:
+			r.Error = "call_failed"
+		}
+		r.Reason = err.Error()
+	}
+	return r
+}
+
+// result returns the content of the reply or the error it represents.
+func (r *jsonReply) result() (Content, error) {
+	if r.Error == "" {
+		return decodeContent(r.D, r.E, r.Y)
+	}
+	switch r.Error {
+	case "call_error":
+		return nil, &CallError{r.Reason}
+	case "route_unknown":
+		return nil, &UnknownRouteError{r.Route}
+	}
+	return nil, (&jsonErrorBody{ID: r.Error, Reason: r.Reason}).err()
+}
+
+// decodeReplyFrame decodes frame if it is a reply to a call.  If frame is not
+// a reply decodeReplyFrame returns false.
+func decodeReplyFrame(frame []byte) (*jsonReply, bool) {
+	var probe struct {
+		R *string `json:"reply"`
+	}
+	err := json.Unmarshal(frame, &probe)
+	if err != nil || probe.R == nil {
+		return nil, false
+	}
+	r := &jsonReply{}
+	err = json.Unmarshal(frame, r)
+	if err != nil {
+		return nil, false
+	}
+	return r, true
+}
+
+func busCallsHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("POST"))
+			return
+		}
+
+		msg := newJSONMsg(nil)
+		err := json.NewDecoder(r.Body).Decode(msg)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("http_request_invalid", "could not read a complete entity"))
+			return
+		}
+		if msg.S == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("protocol_error", "missing session"))
+			return
+		}
+		if !auth.authorize(w, r, msg.S) {
+			return
+		}
+		if !admit(b, w, r, msg.S) {
+			return
+		}
+		b.sessions.seenFrom(msg.S, remoteHost(r))
+
+		// The call is abandoned if the client disconnects.
+		ctx, cancel := context.WithTimeout(context.Background(), msg.callTimeout())
+		defer cancel()
+		if cn, ok := w.(http.CloseNotifier); ok {
+			closed := cn.CloseNotify()
+			go func() {
+				select {
+				case <-closed:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		reply, err := b.call(ctx, msg.P, msg.S, msg.content(), msg.T)
+		switch err {
+		case ErrSessionKicked:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, jsonKicked())
+			return
+		case ErrClosed:
+			writeClosed(w)
+			return
+		case ErrTimeAhead:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("protocol_error", err.Error()))
+			return
+		case context.DeadlineExceeded:
+			w.WriteHeader(http.StatusGatewayTimeout)
+			fmt.Fprintln(w, jsonError("call_timeout", "no reply was received in time"))
+			return
+		case context.Canceled:
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newJSONReply(msg.R, reply, err))
+	}
+}
+
+// callTimeout returns the amount of time the server waits for a reply to msg.
+// The timeout requested by the client is limited to MaxCallTimeout.
+func (msg *jsonMsg) callTimeout() time.Duration {
+	if msg.W <= 0 {
+		return DefaultCallTimeout
+	}
+	timeout := time.Duration(msg.W) * time.Millisecond
+	if timeout > MaxCallTimeout {
+		return MaxCallTimeout
+	}
+	return timeout
+}
+
+// wsCall handles a call received over ws, sending the reply back over ws.
+func wsCall(b *Bus, ws *websocket.Conn, msg *jsonMsg) {
+	ctx, cancel := context.WithTimeout(context.Background(), msg.callTimeout())
+	defer cancel()
+	reply, err := b.call(ctx, msg.P, msg.S, msg.content(), msg.T)
+	err = websocket.JSON.Send(ws, newJSONReply(msg.R, reply, err))
+	if err != nil {
+		log.Printf("[INFO] Failed to deliver reply to client: %v", err)
+	}
+}
+
+// Call sends content to the server and waits for a handler to reply.  If
+// ctx has no deadline the call times out after c.CallTimeout, or
+// DefaultCallTimeout if that is zero.  The server stops waiting for a reply
+// at the same time, though no later than its MaxCallTimeout.  A handler may fail the call, in which
+// case a *CallError is returned, and a call a Router could not route fails
+// with an *UnknownRouteError.
+func (c *Client) Call(ctx context.Context, content Content) (Content, error) {
+	return c.CallOn(ctx, "", content)
+}
+
+// CallOn is like Call but sends the message on the named topic.
+func (c *Client) CallOn(ctx context.Context, topic string, content Content) (Content, error) {
+	if c.Session == "" {
+		return nil, fmt.Errorf("no session id")
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := c.CallTimeout
+		if timeout <= 0 {
+			timeout = DefaultCallTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	m := newJSONMsg(newTopicMsg(topic, c.Session, content, c.now))
+	if deadline, ok := ctx.Deadline(); ok {
+		m.W = int64(deadline.Sub(time.Now()) / time.Millisecond)
+		if m.W <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	c.wsmut.Lock()
+	c.requests++
+	m.R = strconv.FormatUint(c.requests, 10)
+	c.wsmut.Unlock()
+
+	if c.Transport == TransportWebSocket {
+		reply, ok, err := c.wsCall(ctx, m)
+		if ok {
+			if err != nil {
+				return nil, err
+			}
+			return reply.result()
+		}
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.url("/rex/v0/calls"), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Cancel = ctx.Done()
+	resp, err := c.do(req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body jsonErrorBody
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil || body.ID == "" {
+			return nil, fmt.Errorf("%v %s %s", resp.Status, "POST", c.url("/rex/v0/calls"))
+		}
+		return nil, body.err()
+	}
+	reply := &jsonReply{}
+	err = json.NewDecoder(resp.Body).Decode(reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.result()
+}
+
+// wsCall sends m over the client's WebSocket connection and waits for the
+// reply.  If the client does not have an open connection wsCall returns
+// false.
+func (c *Client) wsCall(ctx context.Context, m *jsonMsg) (reply *jsonReply, ok bool, err error) {
+	replyc := make(chan *jsonReply, 1)
+	c.wsmut.Lock()
+	if c.ws == nil {
+		c.wsmut.Unlock()
+		return nil, false, nil
+	}
+	if c.calls == nil {
+		c.calls = make(map[string]chan<- *jsonReply)
+	}
+	c.calls[m.R] = replyc
+	err = websocket.JSON.Send(c.ws, m)
+	c.wsmut.Unlock()
+	defer func() {
+		c.wsmut.Lock()
+		delete(c.calls, m.R)
+		c.wsmut.Unlock()
+	}()
+	if err != nil {
+		return nil, true, err
+	}
+	select {
+	case reply = <-replyc:
+		return reply, true, nil
+	case <-ctx.Done():
+		return nil, true, ctx.Err()
+	}
+}
+
+// wsReply passes a reply received over the client's WebSocket connection to
+// the call waiting for it.
+func (c *Client) wsReply(reply *jsonReply) {
+	c.wsmut.Lock()
+	defer c.wsmut.Unlock()
+	replyc, ok := c.calls[reply.R]
+	if ok {
+		select {
+		case replyc <- reply:
+		default:
+		}
+	}
+}
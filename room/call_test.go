@@ -0,0 +1,208 @@
+package room
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// callHandler replies to calls with the upper case text of the message.
+// Messages containing "fail" fail the call and messages containing "ignore"
+// are not replied to.
+func callHandler() Handler {
+	return hfunc(func(ctx context.Context, msg Msg) {
+		switch msg.Text() {
+		case "fail":
+			ReplyError(ctx, errors.New("invalid move"))
+		case "ignore":
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			Reply(ctx, String("SLOW"))
+		default:
+			Reply(ctx, String("reply:"+msg.Text()))
+		}
+	})
+}
+
+func TestBusCall(t *testing.T) {
+	b := NewBus(context.Background(), callHandler())
+	defer b.close()
+
+	ctx := context.Background()
+	reply, err := b.Call(ctx, "s1", String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Text() != "reply:hello" {
+		t.Errorf("reply: %q", reply.Text())
+	}
+
+	_, err = b.Call(ctx, "s1", String("fail"))
+	if err, ok := err.(*CallError); !ok || err.Reason != "invalid move" {
+		t.Errorf("error: %v", err)
+	}
+
+	_, err = b.Call(ctx, "s1", String("ignore"))
+	if err != ErrNoReply {
+		t.Errorf("error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = b.Call(ctx, "s1", String("slow"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("error: %v", err)
+	}
+}
+
+func TestReplyNotCall(t *testing.T) {
+	errs := make(chan error, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		errs <- Reply(ctx, String("reply"))
+	}))
+	defer b.close()
+
+	b.Message("s1", String("hello"))
+	select {
+	case err := <-errs:
+		if err != ErrNotCall {
+			t.Errorf("error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not handled")
+	}
+}
+
+func testClientCall(t *testing.T, c *Client) {
+	ctx := context.Background()
+	reply, err := c.Call(ctx, String("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Text() != "reply:hello" {
+		t.Errorf("reply: %q", reply.Text())
+	}
+
+	_, err = c.Call(ctx, String("fail"))
+	if err, ok := err.(*CallError); !ok || err.Reason != "invalid move" {
+		t.Errorf("error: %v", err)
+	}
+
+	_, err = c.Call(ctx, String("ignore"))
+	if err != ErrNoReply {
+		t.Errorf("error: %v", err)
+	}
+
+	c.CallTimeout = 50 * time.Millisecond
+	_, err = c.Call(ctx, String("slow"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("error: %v", err)
+	}
+}
+
+func TestClientCall(t *testing.T) {
+	b := NewBus(context.Background(), callHandler())
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	err := c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testClientCall(t, c)
+}
+
+func TestClientCallWebSocket(t *testing.T) {
+	b := NewBus(context.Background(), callHandler())
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.Transport = TransportWebSocket
+	err := c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, 0)
+	for {
+		c.wsmut.Lock()
+		open := c.ws != nil
+		c.wsmut.Unlock()
+		if open {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	testClientCall(t, c)
+}
+
+func TestBusCallLateReply(t *testing.T) {
+	late := make(chan context.Context, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		late <- ctx
+	}))
+	defer b.close()
+
+	_, err := b.Call(context.Background(), "s1", String("hello"))
+	if err != ErrNoReply {
+		t.Errorf("error: %v", err)
+	}
+	// the call failed once the handler returned.
+	err = Reply(<-late, String("too late"))
+	if err != ErrReplied {
+		t.Errorf("late reply: %v", err)
+	}
+}
+
+func TestJSONMsgCallTimeout(t *testing.T) {
+	for _, test := range []struct {
+		ms      int64
+		timeout time.Duration
+	}{
+		{0, DefaultCallTimeout},
+		{-1, DefaultCallTimeout},
+		{50, 50 * time.Millisecond},
+		{int64(2 * MaxCallTimeout / time.Millisecond), MaxCallTimeout},
+	} {
+		msg := &jsonMsg{W: test.ms}
+		timeout := msg.callTimeout()
+		if timeout != test.timeout {
+			t.Errorf("%d: timeout: %v (!= %v)", test.ms, timeout, test.timeout)
+		}
+	}
+}
+
+func TestHTTPBusCallTimeout(t *testing.T) {
+	b := NewBus(context.Background(), callHandler())
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	start := time.Now()
+	resp, err := http.Post(s.URL+"/rex/v0/calls", "application/json", strings.NewReader(`{
+		"session": "s1",
+		"time": "0000010000000001",
+		"data": "slow",
+		"timeout": 50
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status: %s", resp.Status)
+	}
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Errorf("server waited %v for a reply", d)
+	}
+}
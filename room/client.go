@@ -2,29 +2,92 @@ package room
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/bmatsuo/uuid"
 	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
 )
 
 // Client is an interface to a remote REx server.
 type Client struct {
-	Host    string
-	Port    int
-	Handler EventHandler
-	HTTP    *http.Client
-	Now     func() Time
-	Session string
+	Host      string
+	Port      int
+	Handler   EventHandler
+	HTTP      *http.Client
+	Transport Transport
+	Session   string
+
+	// Now, if not nil, returns the time given to messages sent by the
+	// client.  By default messages are given times from a clock which is
+	// merged with the time of each event received, so that messages are
+	// later than the events the client had seen when sending them.
+	Now func() Time
+
+	// JoinCode is presented to the server when CreateSession is called.  It
+	// is required when the server has a JoinPolicy.
+	JoinCode string
+
+	// Device optionally identifies the client device when a session is
+	// created, allowing the server to prevent a banned device from joining
+	// again with a new session.
+	Device string
+
+	// Token authorizes requests made on behalf of Session.  It is issued by
+	// the server during CreateSession and must be retained alongside Session
+	// in order to restore the client.
+	Token string
+
+	// Acknowledge causes Send to return only after server handlers have
+	// processed the message.  Messages are always sent using HTTP when
+	// Acknowledge is set.
+	Acknowledge bool
+
+	// Retries is the number of times Send retries a message when it cannot
+	// tell whether the server received it.  Each message carries an
+	// identifier so the server discards any duplicates.
+	Retries int
+
+	// RetryBackoff is the delay before Send first retries a message.  Each
+	// further retry doubles the delay.  If zero DefaultRetryBackoff is used.
+	RetryBackoff time.Duration
+
+	// CallTimeout is the amount of time Call waits for a reply when its
+	// context has no deadline.  If zero DefaultCallTimeout is used.  The
+	// server waits no longer than its MaxCallTimeout.
+	CallTimeout time.Duration
+
+	wsmut    sync.Mutex
+	ws       *websocket.Conn
+	requests uint64 // the number of calls made
+	messages uint64 // the number of messages sent
+	idprefix string // random prefix for message ids
+	queue    *outQueue
+	calls    map[string]chan<- *jsonReply // calls awaiting replies over ws
+	clock    Clock
+	sync     clockEstimate // estimate of the server clock
+	private  int           // the index of the next private event
 }
 
+// DefaultRetryBackoff is the delay before a client first retries a message
+// when Client.RetryBackoff is zero.
+var DefaultRetryBackoff = 100 * time.Millisecond
+
+// maxRetryBackoff limits the delay between retries of a message.
+const maxRetryBackoff = 10 * time.Second
+
 // NewClient allocates and returns a new client with its Handler set to h.
 func NewClient(h EventHandler) *Client {
 	return &Client{Handler: h}
@@ -46,6 +109,31 @@ func (c *Client) http() *http.Client {
 	return c.HTTP
 }
 
+// do sends req to the server, presenting c.Token if the client has one.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return c.http().Do(req)
+}
+
+func (c *Client) get(pathquery string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.url(pathquery), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+func (c *Client) post(pathquery string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.url(pathquery), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
 func (c *Client) url(pathquery string) string {
 	if strings.HasPrefix(pathquery, "/") {
 		pathquery = pathquery[1:]
@@ -53,120 +141,402 @@ func (c *Client) url(pathquery string) string {
 	return fmt.Sprintf("http://%s:%d/%s", c.Host, c.Port, pathquery)
 }
 
-// events performs a long-poll for events on the server.
-func (c *Client) events(ctx context.Context, start int) ([]Event, error) {
-	log.Printf("POLLING %d", start)
-	pathquery := fmt.Sprintf("/rex/v0/events?start=%d", start)
-	resp, err := c.http().Get(c.url(pathquery))
+// eventsPathQuery returns the path and query used to request events from the
+// given endpoint beginning at the index in starts for each topic.  Events are
+// requested on behalf of c.Session.
+func (c *Client) eventsPathQuery(path string, starts map[string]int) string {
+	q := url.Values{}
+	if start, ok := starts[""]; ok && len(starts) == 1 {
+		q.Set("start", strconv.Itoa(start))
+	} else {
+		var topics []string
+		for topic := range starts {
+			topics = append(topics, topic)
+		}
+		sort.Strings(topics)
+		for _, topic := range topics {
+			q.Add("topic", topic)
+			q.Add("start", strconv.Itoa(starts[topic]))
+		}
+	}
+	if c.Session != "" {
+		q.Set("session", c.Session)
+	}
+	return path + "?" + q.Encode()
+}
+
+// events streams events from the server beginning at the index in starts for
+// each topic and passes each one to fn as soon as it is decoded.  events
+// returns nil when ctx is cancelled.  The server holds the response open until
+// the room closes, so if the response ends io.ErrUnexpectedEOF is returned.
+// If the server stops sending heartbeats the connection is assumed to have
+// failed and an error is returned.  If live is not nil it is called once the server
+// begins streaming events.
+func (c *Client) events(ctx context.Context, starts map[string]int, live func(), fn func(Event)) error {
+	pathquery := c.eventsPathQuery("/rex/v0/events", starts) + "&stream=true"
+	resp, err := c.get(pathquery)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusGone, http.StatusForbidden, http.StatusServiceUnavailable:
+		var body jsonErrorBody
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil {
+			return fmt.Errorf("%v %s", resp.Status, err)
+		}
+		return body.err()
+	}
 	if resp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return nil, errors.New(string(b))
+		return errors.New(string(b))
+	}
+	if live != nil {
+		live()
 	}
-	var events []Event
-	dec := json.NewDecoder(resp.Body)
-	ejs := newJSONEvent(nil)
+
+	body := newIdleReader(resp.Body, clientIdleTimeout)
+	defer body.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			body.Close()
+		case <-done:
+		}
+	}()
+
+	dec := json.NewDecoder(body)
 	for {
-		*ejs = jsonEvent{}
-		err := dec.Decode(&ejs)
+		var frame json.RawMessage
+		err := dec.Decode(&frame)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		ejs, err := decodeEventFrame(frame)
 		if err != nil {
-			break
+			return err
 		}
-		events = append(events, ejs.Event)
+		fn(ejs.Event)
 	}
-	if err == io.EOF {
-		return events, nil
+}
+
+// State retrieves the latest snapshot of application state from the server.
+func (c *Client) State(ctx context.Context) (*Snapshot, error) {
+	resp, err := c.get("/rex/v0/state")
+	if err != nil {
+		return nil, err
 	}
-	return events, err
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(string(b))
+	}
+	snap := newJSONSnapshot(nil)
+	err = json.NewDecoder(resp.Body).Decode(snap)
+	if err != nil {
+		return nil, err
+	}
+	return snap.Snapshot, nil
 }
 
-// send sends a message to the remote server with the given session identifier
-// (not c.Session).
-func (c *Client) send(ctx context.Context, session string, content Content) error {
-	_dt := c.Now
-	if _dt == nil {
-		_dt = dt.Now
+// catchUp retrieves the server state, passes it to c.Handler and returns the
+// index of the first event not reflected in the state.
+func (c *Client) catchUp(ctx context.Context) (next int, err error) {
+	snap, err := c.State(ctx)
+	if err != nil {
+		return 0, err
 	}
-	_m := newMsg(session, content, _dt)
+	c.observe(snap.Time)
+	if h, ok := c.Handler.(SnapshotHandler); ok {
+		h.HandleSnapshot(ctx, c, snap)
+	}
+	return int(snap.Next), nil
+}
+
+// send sends a message on topic to the remote server with the given session
+// identifier (not c.Session).
+func (c *Client) send(ctx context.Context, topic string, session string, content Content) error {
+	return c.deliver(ctx, c.newMessage(topic, session, content), c.Retries)
+}
+
+// now returns the time given to messages sent by c.
+func (c *Client) now() Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return c.clock.Now()
+}
+
+// newMessage returns a new message with a unique identifier.
+func (c *Client) newMessage(topic string, session string, content Content) *jsonMsg {
+	_m := newTopicMsg(topic, session, content, c.now)
 	m := newJSONMsg(_m)
+	m.I = c.messageID()
+	return m
+}
+
+// deliver sends m to the server, retrying up to the given number of times
+// with exponential backoff when it cannot tell whether m was received.  If the
+// final attempt fails for that reason a retryableError is returned.  If ctx is
+// done before m is delivered ctx.Err() is returned.
+func (c *Client) deliver(ctx context.Context, m *jsonMsg, retries int) error {
+	if c.Transport == TransportWebSocket && !c.Acknowledge {
+		ok, err := c.wsSend(m)
+		if ok && err != nil {
+			return retryableError{err}
+		}
+		if ok {
+			return nil
+		}
+	}
 	b, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	body := bytes.NewReader(b)
-	u := c.url("/rex/v0/messages")
-	resp, err := c.http().Post(u, "application/json", body)
+	path := "/rex/v0/messages"
+	if c.Acknowledge {
+		path += "?wait=true"
+	}
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for i := 0; ; i++ {
+		err = c.postMessage(ctx, path, b)
+		if _, ok := err.(retryableError); !ok || i >= retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// retryableError is an error sending a message which may not have been
+// received by the server.
+type retryableError struct {
+	error
+}
+
+// postMessage posts the encoded message m to path.  The request is abandoned
+// if ctx is done.
+func (c *Client) postMessage(ctx context.Context, path string, m []byte) error {
+	req, err := http.NewRequest("POST", c.url(path), bytes.NewReader(m))
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Cancel = ctx.Done()
+	resp, err := c.do(req)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return retryableError{err}
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		b, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("%v %s %s: %s", resp.Status, "POST", u, b)
+		var body jsonErrorBody
+		if json.Unmarshal(b, &body) == nil && body.ID != "" && body.ID != "message_undelivered" {
+			return body.err()
+		}
+		err := fmt.Errorf("%v %s %s: %s", resp.Status, "POST", c.url(path), b)
+		if resp.StatusCode >= 500 {
+			return retryableError{err}
+		}
+		return err
 	}
 	return nil
 }
 
-// CreateSession initializes c.Session by registering an identifier with the
-// remote bus. If the value is already set no registration is performed.
+// messageID returns a new identifier for a message sent by c.
+func (c *Client) messageID() string {
+	c.wsmut.Lock()
+	defer c.wsmut.Unlock()
+	if c.idprefix == "" {
+		var buf [8]byte
+		rand.Read(buf[:])
+		c.idprefix = hex.EncodeToString(buf[:])
+	}
+	c.messages++
+	return c.idprefix + "-" + strconv.FormatUint(c.messages, 10)
+}
+
+// postJSON posts req to the server encoded as JSON and decodes the response
+// into resp.  Error objects returned by the server are converted to errors.
+func (c *Client) postJSON(path string, req, resp interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := c.post(path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		var body jsonErrorBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.ID == "" {
+			return fmt.Errorf("%v %s %s", r.Status, "POST", c.url(path))
+		}
+		return body.err()
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// CreateSession initializes c.Session by registering a session with the
+// remote bus under the given name.  The session identifier is assigned by the
+// server.  If the value is already set no registration is performed.  If the
+// server requires a join code c.JoinCode must be set, and c.Token is set when
+// the server accepts it.
 func (c *Client) CreateSession(ctx context.Context, name string) error {
+	return c.CreateSessionMetadata(ctx, name, nil)
+}
+
+// CreateSessionMetadata is like CreateSession but also registers application
+// defined metadata for the session, which server handlers can retrieve with
+// LookupSession.
+func (c *Client) CreateSessionMetadata(ctx context.Context, name string, metadata map[string]string) error {
 	if c.Session != "" {
 		return nil
 	}
+	req := map[string]interface{}{
+		"name":     name,
+		"code":     c.JoinCode,
+		"device":   c.Device,
+		"metadata": metadata,
+	}
+	var resp jsonSession
+	err := c.postJSON("/rex/v0/sessions", req, &resp)
+	if err != nil {
+		return err
+	}
+	c.Session = resp.Session
+	c.Token = resp.Token
+	return nil
+}
 
-	session := uuid.New()
-	// FIXME: first message sent is the name of the session? that seems...
-	// ~reasonable.
-	err := c.send(ctx, session, String(name))
-	if err == nil {
-		c.Session = session
+// Leave tells the server that c.Session is leaving the room.  Server
+// handlers are notified that the session left rather than waiting for it to
+// become idle.  The session may continue to be used afterwards, in which
+// case it joins the room again.
+func (c *Client) Leave(ctx context.Context) error {
+	if c.Session == "" {
+		return fmt.Errorf("no session id")
+	}
+	path := "/rex/v0/sessions?" + url.Values{"session": {c.Session}}.Encode()
+	req, err := http.NewRequest("DELETE", c.url(path), nil)
+	if err != nil {
+		return err
 	}
-	return err
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v %s %s: %s", resp.Status, "DELETE", c.url(path), b)
+	}
+	return nil
 }
 
 // Send sends a message to the remote server using the given session
-// identifier.
+// identifier.  If the client has an outbound queue the message is queued and
+// Send only returns an error if it cannot be queued.
 func (c *Client) Send(ctx context.Context, content Content) error {
+	return c.SendOn(ctx, "", content)
+}
+
+// SendOn is like Send but sends the message on the named topic.
+func (c *Client) SendOn(ctx context.Context, topic string, content Content) error {
 	if c.Session == "" {
 		return fmt.Errorf("no session id")
 	}
-	return c.send(ctx, c.Session, content)
+	if c.queue != nil {
+		return c.queue.push(c.newMessage(topic, c.Session, content))
+	}
+	return c.send(ctx, topic, c.Session, content)
 }
 
-// Run processes events received from the remote bus.
+// Run processes events received from the remote bus.  If start is negative
+// Run first retrieves the server state and begins processing events at the
+// index it covers.  The snapshot is passed to c.Handler if it implements
+// SnapshotHandler.  If the server has compacted events Run needs, a
+// *CompactedError is returned and the client should catch up by calling Run
+// with a negative start.  Events sent to c.Session with Bus.EventTo are
+// processed too, on PrivateTopic, if the client has a session token.  Events
+// are received using the protocol selected by c.Transport.  If the connection
+// fails or the server ends the event stream Run returns an error, and the
+// caller should wait before calling Run again.  RunSupervised reconnects with
+// backoff.
 func (c *Client) Run(ctx context.Context, start int) (next int, err error) {
-	term := ctx.Done()
-evloop:
-	for {
-		if start < next {
-			start = next
-		}
-		evs, err := c.events(ctx, start)
+	if start < 0 {
+		start, err = c.catchUp(ctx)
 		if err != nil {
-			return next, err
+			return 0, err
 		}
-		log.Printf("[INFO] Found %d new events", len(evs))
-		select {
-		case <-term:
-			break evloop
-		default:
-		}
-		for _, ev := range evs {
-			if c.Handler != nil {
-				c.Handler.HandleEvent(ctx, c, ev)
-			}
-			select {
-			case <-term:
-				break evloop
-			default:
-			}
-			next = int(ev.Index()) + 1
+		next = start
+	}
+	nexts := map[string]int{"": start}
+	err = c.run(ctx, nexts, nil)
+	return nexts[""], err
+}
+
+// RunTopics is like Run but processes events from each topic in starts,
+// beginning at the corresponding index.  The index following the last event
+// processed in each topic is returned.  Unlike Run, RunTopics does not
+// retrieve server state for negative start indices.
+func (c *Client) RunTopics(ctx context.Context, starts map[string]int) (next map[string]int, err error) {
+	next = make(map[string]int, len(starts))
+	for topic, start := range starts {
+		next[topic] = start
+	}
+	err = c.run(ctx, next, nil)
+	return next, err
+}
+
+// run processes events for each topic in next, beginning at the index in
+// next.  As events are processed next is updated.  If live is not nil it is
+// called each time a connection to the server is established.  If the client
+// has a session token the events sent to c.Session on PrivateTopic are
+// processed as well, continuing from the last one the client processed.
+func (c *Client) run(ctx context.Context, next map[string]int, live func()) error {
+	if c.Session != "" && c.Token != "" {
+		if _, ok := next[PrivateTopic]; !ok {
+			next[PrivateTopic] = c.private
 		}
+		defer func() { c.private = next[PrivateTopic] }()
 	}
-	return next, nil
+	if c.Transport == TransportWebSocket {
+		return c.runWebSocket(ctx, next, live)
+	}
+	return c.events(ctx, next, live, func(ev Event) {
+		c.observe(ev.Time())
+		if c.Handler != nil {
+			c.Handler.HandleEvent(ctx, c, ev)
+		}
+		next[ev.Topic()] = int(ev.Index()) + 1
+	})
 }
 
 // EventHandler is part of the client's event loop.
@@ -174,6 +544,14 @@ type EventHandler interface {
 	HandleEvent(context.Context, *Client, Event)
 }
 
+// SnapshotHandler is an EventHandler which can apply application state
+// retrieved from the server.  HandleSnapshot is called before any events
+// following the snapshot are passed to HandleEvent.
+type SnapshotHandler interface {
+	EventHandler
+	HandleSnapshot(context.Context, *Client, *Snapshot)
+}
+
 // ehfunc implements EventHandler
 type ehfunc func(context.Context, *Client, Event)
 
@@ -0,0 +1,276 @@
+package room
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+	"golang.org/x/net/context"
+)
+
+// Codec encodes Go values as the data of Content.
+type Codec interface {
+	// ContentType returns the media type of data produced by the Codec,
+	// such as "application/json".
+	ContentType() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codecs implemented by the package.  Data produced by the binary codecs is
+// base64 encoded when it is transmitted.
+var (
+	JSON    Codec = jsonCodec{}
+	Gob     Codec = gobCodec{}
+	MsgPack Codec = &ugorjiCodec{"application/msgpack", &codec.MsgpackHandle{WriteExt: true}}
+	CBOR    Codec = &ugorjiCodec{"application/cbor", &codec.CborHandle{}}
+)
+
+var codecs = map[string]Codec{}
+
+func init() {
+	for _, c := range []Codec{JSON, Gob, MsgPack, CBOR} {
+		codecs[c.ContentType()] = c
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// gobCodec encodes each value as a self-contained gob stream, including the
+// definition of its type.
+type gobCodec struct{}
+
+func (gobCodec) ContentType() string {
+	return "application/x-gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type ugorjiCodec struct {
+	contentType string
+	handle      codec.Handle
+}
+
+func (c *ugorjiCodec) ContentType() string {
+	return c.contentType
+}
+
+func (c *ugorjiCodec) Marshal(v interface{}) ([]byte, error) {
+	var data []byte
+	err := codec.NewEncoderBytes(&data, c.handle).Encode(v)
+	return data, err
+}
+
+func (c *ugorjiCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, c.handle).Decode(v)
+}
+
+// typedContent is Content labelled with a content type.
+type typedContent struct {
+	Content
+	contentType string
+}
+
+// Typed returns c labelled with contentType, which is transmitted along with
+// the data of c.
+func Typed(c Content, contentType string) Content {
+	if contentType == "" {
+		return c
+	}
+	return typedContent{c, contentType}
+}
+
+// ContentType returns the content type of c, or an empty string if c has no
+// content type.  Messages, events and snapshots have the content type of the
+// content they were created with.
+func ContentType(c Content) string {
+	switch c := c.(type) {
+	case typedContent:
+		return c.contentType
+	case *simpleEvent:
+		return ContentType(c.Content)
+	case *simpleMsg:
+		return ContentType(c.Content)
+	case *Snapshot:
+		return ContentType(c.Content)
+	}
+	return ""
+}
+
+// ErrUntyped is returned by TypeRegistry.Decode when content has no type tag.
+var ErrUntyped = errors.New("content has no type tag")
+
+// UnknownTypeError is returned by TypeRegistry.Decode when the type tag of
+// content has not been registered, for instance because it was sent by a
+// newer version of the application.
+type UnknownTypeError struct {
+	Tag string
+}
+
+func (err *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown type tag %q", err.Tag)
+}
+
+// TypeRegistry maps type tags to Go types, so that values can be sent as
+// Content and decoded into values of the same type by the receiver.  The
+// content type of encoded values names the codec and the type tag, such as
+// "application/json; tag=move".  A TypeRegistry is safe for concurrent use.
+type TypeRegistry struct {
+	codec Codec
+	mut   sync.RWMutex
+	types map[string]reflect.Type
+	tags  map[reflect.Type]string
+}
+
+// NewTypeRegistry returns a new TypeRegistry encoding values with c.  Values
+// encoded with any codec provided by the package can be decoded.
+func NewTypeRegistry(c Codec) *TypeRegistry {
+	return &TypeRegistry{
+		codec: c,
+		types: make(map[string]reflect.Type),
+		tags:  make(map[reflect.Type]string),
+	}
+}
+
+// Register associates tag with the type of v.  Decoded values have the same
+// type as v, so registering a pointer causes pointers to be decoded.  Register
+// returns an error if tag or the type of v is already registered.
+func (r *TypeRegistry) Register(tag string, v interface{}) error {
+	t := reflect.TypeOf(v)
+	if tag == "" || t == nil {
+		return fmt.Errorf("invalid registration")
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if _, ok := r.types[tag]; ok {
+		return fmt.Errorf("type tag %q already registered", tag)
+	}
+	if _, ok := r.tags[t]; ok {
+		return fmt.Errorf("type %v already registered", t)
+	}
+	r.types[tag] = t
+	r.tags[t] = tag
+	return nil
+}
+
+// Encode returns Content containing v, which must have a registered type.
+func (r *TypeRegistry) Encode(v interface{}) (Content, error) {
+	t := reflect.TypeOf(v)
+	r.mut.RLock()
+	tag, ok := r.tags[t]
+	r.mut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("type %v is not registered", t)
+	}
+	data, err := r.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	contentType := mime.FormatMediaType(r.codec.ContentType(), map[string]string{"tag": tag})
+	return Typed(Bytes(data), contentType), nil
+}
+
+// Decode returns the value contained in c.  If c has no type tag Decode
+// returns ErrUntyped, and if the tag is not registered it returns an
+// *UnknownTypeError.
+func (r *TypeRegistry) Decode(c Content) (interface{}, error) {
+	contentType := ContentType(c)
+	if contentType == "" {
+		return nil, ErrUntyped
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	tag := params["tag"]
+	if tag == "" {
+		return nil, ErrUntyped
+	}
+	r.mut.RLock()
+	t, ok := r.types[tag]
+	r.mut.RUnlock()
+	if !ok {
+		return nil, &UnknownTypeError{tag}
+	}
+	dec, ok := codecs[mediaType]
+	if !ok && mediaType == r.codec.ContentType() {
+		dec, ok = r.codec, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+
+	ptr := t.Kind() == reflect.Ptr
+	if ptr {
+		t = t.Elem()
+	}
+	v := reflect.New(t)
+	err = dec.Unmarshal(c.Data(), v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	if ptr {
+		return v.Interface(), nil
+	}
+	return v.Elem().Interface(), nil
+}
+
+// Handler returns a Handler which decodes messages using r and passes the
+// decoded values to fn.  Messages which cannot be decoded are logged and
+// dropped, and calls which cannot be decoded fail.
+func (r *TypeRegistry) Handler(fn func(ctx context.Context, msg Msg, v interface{})) Handler {
+	return hfunc(func(ctx context.Context, msg Msg) {
+		v, err := r.Decode(msg)
+		if err != nil {
+			log.Printf("[INFO] Failed to decode message from session %q: %v", msg.Session(), err)
+			reject(ctx, err)
+			return
+		}
+		fn(ctx, msg, v)
+	})
+}
+
+// EventHandler returns an EventHandler which decodes events using r and
+// passes the decoded values to fn.  Events which cannot be decoded are logged
+// and skipped.
+func (r *TypeRegistry) EventHandler(fn func(ctx context.Context, c *Client, event Event, v interface{})) EventHandler {
+	return ehfunc(func(ctx context.Context, c *Client, event Event) {
+		v, err := r.Decode(event)
+		if err != nil {
+			log.Printf("[INFO] Failed to decode event %d: %v", event.Index(), err)
+			return
+		}
+		fn(ctx, c, event, v)
+	})
+}
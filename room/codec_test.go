@@ -0,0 +1,139 @@
+package room
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type testMove struct {
+	Player string
+	X, Y   int
+}
+
+type testChat struct {
+	Text string
+}
+
+func TestCodecs(t *testing.T) {
+	move := testMove{"alice", 3, -4}
+	for _, c := range []Codec{JSON, Gob, MsgPack, CBOR} {
+		data, err := c.Marshal(move)
+		if err != nil {
+			t.Errorf("%s: marshal: %v", c.ContentType(), err)
+			continue
+		}
+		var v testMove
+		err = c.Unmarshal(data, &v)
+		if err != nil {
+			t.Errorf("%s: unmarshal: %v", c.ContentType(), err)
+			continue
+		}
+		if v != move {
+			t.Errorf("%s: %#v", c.ContentType(), v)
+		}
+	}
+}
+
+func TestTypeRegistry(t *testing.T) {
+	r := NewTypeRegistry(MsgPack)
+	err := r.Register("move", testMove{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Register("chat", &testChat{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Register("move", testChat{}) == nil {
+		t.Errorf("registered a tag twice")
+	}
+	if r.Register("move2", testMove{}) == nil {
+		t.Errorf("registered a type twice")
+	}
+
+	for _, v := range []interface{}{testMove{"bob", 1, 2}, &testChat{"hello"}} {
+		c, err := r.Encode(v)
+		if err != nil {
+			t.Errorf("encode %#v: %v", v, err)
+			continue
+		}
+		// the content type survives the trip through the wire format.
+		js := newJSONMsg(newMsg("s", c, new(Clock).Now))
+		var m jsonMsg
+		b, _ := js.MarshalJSON()
+		err = m.UnmarshalJSON(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := r.Decode(m.Msg)
+		if err != nil {
+			t.Errorf("decode %#v: %v", v, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, v) {
+			t.Errorf("decoded %#v (!= %#v)", decoded, v)
+		}
+	}
+
+	if _, err := r.Encode(42); err == nil {
+		t.Errorf("encoded an unregistered type")
+	}
+	if _, err := r.Decode(String("{}")); err != ErrUntyped {
+		t.Errorf("untyped content: %v", err)
+	}
+	_, err = r.Decode(Typed(String("{}"), "application/json; tag=jump"))
+	if _, ok := err.(*UnknownTypeError); !ok {
+		t.Errorf("unknown tag: %v", err)
+	}
+
+	// values from peers using another codec can be decoded.
+	decoded, err := r.Decode(Typed(String(`{"Text":"hi"}`), "application/json; tag=chat"))
+	if err != nil || !reflect.DeepEqual(decoded, &testChat{"hi"}) {
+		t.Errorf("json: %#v %v", decoded, err)
+	}
+}
+
+func TestTypeRegistryHandler(t *testing.T) {
+	r := NewTypeRegistry(JSON)
+	r.Register("move", testMove{})
+	moves := make(chan testMove, 1)
+	b := NewBus(context.Background(), r.Handler(func(ctx context.Context, msg Msg, v interface{}) {
+		switch v := v.(type) {
+		case testMove:
+			moves <- v
+			Reply(ctx, String("ok"))
+		}
+	}))
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.Session = "session-01"
+	ctx := context.Background()
+	content, err := r.Encode(testMove{"carol", 5, 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Call(ctx, content)
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+	select {
+	case move := <-moves:
+		if move != (testMove{"carol", 5, 6}) {
+			t.Errorf("move: %#v", move)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	_, err = c.Call(ctx, String("move"))
+	if _, ok := err.(*CallError); !ok {
+		t.Errorf("untyped call: %v", err)
+	}
+}
@@ -1,6 +1,11 @@
 package room
 
-import "encoding/json"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
 
 // Content is application data that is transmitted over a bus.
 type Content interface {
@@ -49,12 +54,52 @@ func (c contentString) Text() string {
 	return string(c)
 }
 
-// Event is a broadcast message from the server to all clients.  Unlike Msg an
-// event does not have an associated session identifier because it is intended
-// for all clients.
+// encodingBase64 is the content encoding of data which is not valid UTF-8.
+const encodingBase64 = "base64"
+
+// encodeContent returns the data of c as it is transmitted in JSON, along with
+// its encoding.  Text is sent as is with no encoding so that clients unaware
+// of encodings continue to work.  Binary data, which JSON strings cannot
+// hold, is encoded using base64.
+func encodeContent(c Content) (data string, encoding string) {
+	if c == nil {
+		return "", ""
+	}
+	if s := c.Text(); utf8.ValidString(s) {
+		return s, ""
+	}
+	return base64.StdEncoding.EncodeToString(c.Data()), encodingBase64
+}
+
+// decodeContent reverses encodeContent.  The decoded content is labelled with
+// contentType, if it is not empty.
+func decodeContent(data string, encoding string, contentType string) (Content, error) {
+	switch encoding {
+	case "":
+		return Typed(String(data), contentType), nil
+	case encodingBase64:
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 content: %v", err)
+		}
+		return Typed(Bytes(b), contentType), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// Event is a message from the server to clients.  Unlike Msg an event does not
+// have an associated session identifier because it is typically intended for
+// all clients.  Events sent with Bus.EventTo are only delivered to the
+// specified sessions, on PrivateTopic.
 type Event interface {
+	// Index returns the position of the event in the log of its topic.
 	Index() uint64
 
+	// Topic returns the name of the topic the event was broadcast on.  The
+	// default topic is named by the empty string.
+	Topic() string
+
 	Time() Time
 
 	Content
@@ -66,20 +111,36 @@ type Msg interface {
 	// the message.
 	Session() string
 
+	// Topic returns the name of the topic the message was sent on.  The
+	// default topic is named by the empty string.
+	Topic() string
+
 	Time() Time
 
 	Content
 }
 
 func newEvent(i uint64, c Content, t func() Time) Event {
-	event := &simpleEvent{i, t(), c}
+	return newTopicEvent("", i, c, t)
+}
+
+func newTopicEvent(topic string, i uint64, c Content, t func() Time) *simpleEvent {
+	event := &simpleEvent{
+		topic:   topic,
+		i:       i,
+		t:       t(),
+		Content: c,
+	}
 	return event
 }
 
 type jsonEvent struct {
 	I     uint64 `json:"index"`
+	P     string `json:"topic,omitempty"`
 	T     Time   `json:"time"`
 	D     string `json:"data"`
+	E     string `json:"encoding,omitempty"` // the encoding of D, if any
+	Y     string `json:"type,omitempty"`     // the content type of D, if any
 	Event `json:"-"`
 }
 
@@ -87,11 +148,14 @@ func newJSONEvent(event Event) *jsonEvent {
 	if event == nil {
 		return &jsonEvent{}
 	}
-	return &jsonEvent{
+	ejs := &jsonEvent{
 		I: event.Index(),
+		P: event.Topic(),
 		T: event.Time(),
-		D: event.Text(),
 	}
+	ejs.D, ejs.E = encodeContent(event)
+	ejs.Y = ContentType(event)
+	return ejs
 }
 
 func (event *jsonEvent) MarshalJSON() ([]byte, error) {
@@ -105,18 +169,25 @@ func (event *jsonEvent) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	event.Event = newEvent(
+	c, err := decodeContent(event.D, event.E, event.Y)
+	if err != nil {
+		return err
+	}
+	event.Event = newTopicEvent(
+		event.P,
 		event.I,
-		String(event.D),
+		c,
 		func() Time { return event.T },
 	)
 	return nil
 }
 
 type simpleEvent struct {
-	i uint64
-	t Time
+	topic string
+	i     uint64
+	t     Time
 	Content
+	seq uint64 // The order of the event among all topics on a Bus
 }
 
 var _ Event = &simpleEvent{}
@@ -125,14 +196,24 @@ func (event *simpleEvent) Index() uint64 {
 	return event.i
 }
 
+func (event *simpleEvent) Topic() string {
+	return event.topic
+}
+
 func (event *simpleEvent) Time() Time {
 	return event.t
 }
 
 type jsonMsg struct {
 	S   string `json:"session"`
+	P   string `json:"topic,omitempty"`
 	T   Time   `json:"time"`
 	D   string `json:"data"`
+	E   string `json:"encoding,omitempty"` // the encoding of D, if any
+	Y   string `json:"type,omitempty"`     // the content type of D, if any
+	I   string `json:"id,omitempty"`       // identifies the message for deduplication
+	R   string `json:"request,omitempty"`  // correlates a call with its reply
+	W   int64  `json:"timeout,omitempty"`  // milliseconds a call waits for its reply
 	Msg `json:"-"`
 }
 
@@ -140,11 +221,14 @@ func newJSONMsg(msg Msg) *jsonMsg {
 	if msg == nil {
 		return &jsonMsg{}
 	}
-	return &jsonMsg{
+	m := &jsonMsg{
 		S: msg.Session(),
+		P: msg.Topic(),
 		T: msg.Time(),
-		D: msg.Text(),
 	}
+	m.D, m.E = encodeContent(msg)
+	m.Y = ContentType(msg)
+	return m
 }
 
 func (msg *jsonMsg) MarshalJSON() ([]byte, error) {
@@ -158,18 +242,35 @@ func (msg *jsonMsg) UnmarshalJSON(b []byte) error {
 	if err != nil {
 		return err
 	}
-	msg.Msg = newMsg(msg.S, String(msg.D), func() Time { return msg.T })
+	c, err := decodeContent(msg.D, msg.E, msg.Y)
+	if err != nil {
+		return err
+	}
+	msg.Msg = newTopicMsg(msg.P, msg.S, c, func() Time { return msg.T })
 	return nil
 }
 
+// content returns the decoded content of msg.
+func (msg *jsonMsg) content() Content {
+	if m, ok := msg.Msg.(*simpleMsg); ok {
+		return m.Content
+	}
+	return Typed(String(msg.D), msg.Y)
+}
+
 func newMsg(session string, c Content, t func() Time) Msg {
-	msg := &simpleMsg{session, t(), c}
+	return newTopicMsg("", session, c, t)
+}
+
+func newTopicMsg(topic string, session string, c Content, t func() Time) Msg {
+	msg := &simpleMsg{topic, session, t(), c}
 	return msg
 }
 
 type simpleMsg struct {
-	sess string
-	t    Time
+	topic string
+	sess  string
+	t     Time
 	Content
 }
 
@@ -179,6 +280,10 @@ func (msg *simpleMsg) Session() string {
 	return msg.sess
 }
 
+func (msg *simpleMsg) Topic() string {
+	return msg.topic
+}
+
 func (msg *simpleMsg) Time() Time {
 	return msg.t
 }
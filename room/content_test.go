@@ -1,34 +1,121 @@
 package room
 
-import "testing"
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
 
 func TestEvent(t *testing.T) {
-	dt := &dumbTime{}
+	clock := &Clock{}
 	c1 := String("test content")
-	e1 := newEvent(1234, c1, dt.Now)
+	e1 := newEvent(1234, c1, clock.Now)
 	if e1.Index() != 1234 {
 		t.Errorf("index: %v", e1.Index())
 	}
 	if e1.Text() != c1.Text() {
 		t.Errorf("content: %v", e1.Text())
 	}
-	if e1.Time().(t64) != 1 {
+	if e1.Time().IsZero() {
 		t.Errorf("time: %v", e1.Time())
 	}
 }
 
 func TestMsg(t *testing.T) {
-	dt := &dumbTime{}
+	clock := &Clock{}
 	sess := "test session"
 	c1 := String("test content")
-	m1 := newMsg(sess, c1, dt.Now)
+	m1 := newMsg(sess, c1, clock.Now)
 	if m1.Session() != sess {
 		t.Errorf("session: %v", m1.Session())
 	}
 	if m1.Text() != c1.Text() {
 		t.Errorf("content: %v", m1.Text())
 	}
-	if m1.Time().(t64) != 1 {
+	if m1.Time().IsZero() {
 		t.Errorf("time: %v", m1.Time())
 	}
 }
+
+func TestContentEncoding(t *testing.T) {
+	for i, test := range []struct {
+		c        Content
+		encoding string
+	}{
+		{String("plain text"), ""},
+		{Bytes([]byte("utf-8 bytes é")), ""},
+		{Bytes([]byte{0x89, 'P', 'N', 'G', 0, 0xff}), "base64"},
+	} {
+		data, encoding := encodeContent(test.c)
+		if encoding != test.encoding {
+			t.Errorf("test %d: encoding %q", i, encoding)
+		}
+		c, err := decodeContent(data, encoding, "")
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(c.Data(), test.c.Data()) {
+			t.Errorf("test %d: data %q", i, c.Data())
+		}
+	}
+
+	_, err := decodeContent("data", "gzip", "")
+	if err == nil {
+		t.Errorf("decoded unsupported encoding")
+	}
+	_, err = decodeContent("not base64!", "base64", "")
+	if err == nil {
+		t.Errorf("decoded invalid base64")
+	}
+}
+
+func TestContentBinaryRoundTrip(t *testing.T) {
+	blob := []byte{0x1f, 0x8b, 0x08, 0x00, 0xde, 0xad, 0xbe, 0xef}
+	msgs := make(chan Msg, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		msgs <- msg
+	}))
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	for _, transport := range []Transport{TransportHTTP, TransportWebSocket} {
+		events := make(chan Event, 1)
+		c := testClient(t, s, ehfunc(func(ctx context.Context, c *Client, event Event) {
+			events <- event
+		}))
+		c.Transport = transport
+		c.Session = "session-01"
+		ctx, cancel := context.WithCancel(context.Background())
+		next := int(b.next())
+		go c.Run(ctx, next)
+
+		b.Event(Bytes(blob))
+		select {
+		case event := <-events:
+			if !bytes.Equal(event.Data(), blob) {
+				t.Errorf("%v: event %q", transport, event.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: timeout receiving event", transport)
+		}
+
+		err := c.Send(ctx, Bytes(blob))
+		if err != nil {
+			t.Fatalf("%v: send: %v", transport, err)
+		}
+		select {
+		case msg := <-msgs:
+			if !bytes.Equal(msg.Data(), blob) {
+				t.Errorf("%v: message %q", transport, msg.Data())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: timeout receiving message", transport)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,70 @@
+package room
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPolicy decides which web pages may use the room API from a browser.
+// Requests without an Origin header come from native clients and are not
+// subject to the policy.
+type originPolicy struct {
+	any     bool
+	origins map[string]bool
+}
+
+// newOriginPolicy returns a policy allowing pages from the given origins, such
+// as "http://192.168.1.20:8080", in addition to pages served by the room
+// itself.  The origin "*" allows pages from any origin.
+func newOriginPolicy(origins []string) *originPolicy {
+	p := &originPolicy{origins: make(map[string]bool, len(origins))}
+	for _, origin := range origins {
+		if origin == "*" {
+			p.any = true
+		}
+		p.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return p
+}
+
+// allowed returns true if a page from origin may make request r.  A nil
+// policy only allows pages served from the host r was sent to.
+func (p *originPolicy) allowed(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	return p.any || p.origins[strings.ToLower(origin)]
+}
+
+// serveCORS adds the headers allowing a cross-origin page to read the
+// response to r, and responds to preflight requests.  Requests from pages whose
+// origin is not allowed are refused, as a browser would still send many of them
+// and only hide the response.  serveCORS returns true if it responded to r.
+func (p *originPolicy) serveCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	w.Header().Add("Vary", "Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	if !p.allowed(r, origin) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, jsonError("origin_forbidden", "requests from the page's origin are not allowed"))
+		return true
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if !preflight {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID")
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,71 @@
+package room
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestHTTPBusCORS(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	origins := newOriginPolicy([]string{"http://guest.example:8080"})
+	s := httptest.NewServer(newHTTPBus(b, nil, origins))
+	defer s.Close()
+
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", s.URL+"/rex/v0/messages", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	resp := preflight("http://guest.example:8080")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("preflight status: %v", resp.Status)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") != "http://guest.example:8080" {
+		t.Errorf("allowed origin: %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "POST") {
+		t.Errorf("allowed methods: %q", resp.Header.Get("Access-Control-Allow-Methods"))
+	}
+	resp = preflight("http://evil.example")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("preflight status: %v", resp.Status)
+	}
+
+	for _, test := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://guest.example:8080", true},
+		{s.URL, true},
+		{"http://evil.example", false},
+	} {
+		req, _ := http.NewRequest("POST", s.URL+"/rex/v0/messages", strings.NewReader(`{"session":"s","data":"hi"}`))
+		req.Header.Set("Origin", test.origin)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		allowed := resp.Header.Get("Access-Control-Allow-Origin") == test.origin
+		if allowed != test.allowed {
+			t.Errorf("%s: allowed: %v", test.origin, allowed)
+		}
+		forbidden := resp.StatusCode == http.StatusForbidden
+		if forbidden == test.allowed {
+			t.Errorf("%s: status: %v", test.origin, resp.Status)
+		}
+	}
+}
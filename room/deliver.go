@@ -0,0 +1,173 @@
+package room
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultDedupWindow is the number of message identifiers a Bus remembers
+// for each session when none is configured.
+var DefaultDedupWindow = 128
+
+// Delivery is a message to be delivered to the handlers of a Bus.
+type Delivery struct {
+	Topic   string
+	Session string
+	Content Content
+
+	// Time is the time the sender gave the message.  The bus clock is
+	// merged with Time so that events broadcast while handling the message
+	// are later than it.  If Time is zero the message is given the current
+	// time of the bus clock.
+	Time Time
+
+	// ID optionally identifies the message.  A message with the same ID as
+	// one recently delivered for the session is discarded, so clients may
+	// safely retry messages when they don't know if they were received.
+	ID string
+
+	// Wait causes Deliver to return only after handlers have processed
+	// the message.  If the message is a duplicate Deliver waits for the
+	// original message to be processed.
+	Wait bool
+}
+
+// envelope carries a message, call or presence change through the bus
+// message loop.
+type envelope struct {
+	msg      Msg
+	id       string // the identifier given to msg by its sender, if any
+	call     *call
+	presence *PresenceChange
+	done     chan struct{} // closed after handlers return, if not nil
+	err      error         // the reason msg was rejected, set before done is closed
+}
+
+type envelopeContextKey struct{}
+
+// withEnvelope returns a context for handling the message in env, through
+// which middleware may reject it.
+func withEnvelope(ctx context.Context, env *envelope) context.Context {
+	return context.WithValue(ctx, envelopeContextKey{}, env)
+}
+
+// Deliver passes a message to b's handlers.  If d.Wait is true Deliver
+// returns after the handlers have processed the message or ctx is done, and
+// returns a *RejectedError if middleware rejected the message.
+func (b *Bus) Deliver(ctx context.Context, d *Delivery) error {
+	if d.Session != "" && b.bans.isKicked(d.Session) {
+		return ErrSessionKicked
+	}
+	err := b.checkTime(d.Session, d.Time)
+	if err != nil {
+		return err
+	}
+	env := &envelope{
+		msg:  newTopicMsg(d.Topic, d.Session, d.Content, b.stamp(d.Session, d.Time)),
+		id:   d.ID,
+		done: make(chan struct{}),
+	}
+	orig, dup := b.dedup.add(d.Session, d.ID, env)
+	if dup {
+		if !d.Wait {
+			return nil
+		}
+		return b.wait(ctx, orig)
+	}
+	b.seen(d.Session, 0)
+	err = b.send(ctx, env)
+	if err != nil {
+		b.dedup.remove(d.Session, d.ID)
+		return err
+	}
+	if !d.Wait {
+		return nil
+	}
+	return b.wait(ctx, env)
+}
+
+// wait waits for the message in env to be handled, returning the reason it
+// was rejected if it was.
+func (b *Bus) wait(ctx context.Context, env *envelope) error {
+	select {
+	case <-env.done:
+		return env.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-b.term:
+		return ErrClosed
+	}
+}
+
+// dedupWindow remembers the most recent message identifiers delivered for
+// each session.
+type dedupWindow struct {
+	mut      sync.Mutex
+	size     int
+	sessions map[string]*sessionDedup
+}
+
+type sessionDedup struct {
+	envs  map[string]*envelope // messages by identifier
+	order []string
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{
+		size:     size,
+		sessions: make(map[string]*sessionDedup),
+	}
+}
+
+// add records id for session.  If id was already recorded add returns the
+// envelope given when it was first added and true.
+func (w *dedupWindow) add(session, id string, env *envelope) (*envelope, bool) {
+	if id == "" || w.size <= 0 {
+		return env, false
+	}
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	s, ok := w.sessions[session]
+	if !ok {
+		s = &sessionDedup{envs: make(map[string]*envelope)}
+		w.sessions[session] = s
+	}
+	if prev, ok := s.envs[id]; ok {
+		return prev, true
+	}
+	s.envs[id] = env
+	s.order = append(s.order, id)
+	if len(s.order) > w.size {
+		delete(s.envs, s.order[0])
+		s.order = s.order[1:]
+	}
+	return env, false
+}
+
+// forget discards the identifiers recorded for session.
+func (w *dedupWindow) forget(session string) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	delete(w.sessions, session)
+}
+
+// remove forgets id for session so that the message may be delivered again.
+func (w *dedupWindow) remove(session, id string) {
+	if id == "" || w.size <= 0 {
+		return
+	}
+	w.mut.Lock()
+	defer w.mut.Unlock()
+	s, ok := w.sessions[session]
+	if !ok {
+		return
+	}
+	delete(s.envs, id)
+	for i := range s.order {
+		if s.order[i] == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package room
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// countHandler counts the messages it handles by content.
+type countHandler struct {
+	mut    sync.Mutex
+	counts map[string]int
+}
+
+func newCountHandler() *countHandler {
+	return &countHandler{counts: make(map[string]int)}
+}
+
+func (h *countHandler) HandleMessage(ctx context.Context, msg Msg) {
+	time.Sleep(10 * time.Millisecond)
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.counts[msg.Text()]++
+}
+
+func (h *countHandler) count(text string) int {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	return h.counts[text]
+}
+
+func TestBusDeliver(t *testing.T) {
+	h := newCountHandler()
+	b := NewBusConfig(context.Background(), &BusConfig{DedupWindow: 2}, h)
+	defer b.close()
+
+	ctx := context.Background()
+	deliver := func(id, text string) {
+		err := b.Deliver(ctx, &Delivery{Session: "s1", ID: id, Content: String(text), Wait: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliver("1", "a")
+	if h.count("a") != 1 {
+		t.Errorf("handler did not finish before Deliver returned")
+	}
+	deliver("1", "a")
+	if h.count("a") != 1 {
+		t.Errorf("duplicate message handled")
+	}
+
+	// the same id from another session is not a duplicate.
+	err := b.Deliver(ctx, &Delivery{Session: "s2", ID: "1", Content: String("a"), Wait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.count("a") != 2 {
+		t.Errorf("message from another session discarded")
+	}
+
+	// ids are forgotten once they leave the window.
+	deliver("2", "b")
+	deliver("3", "c")
+	deliver("1", "a")
+	if h.count("a") != 3 {
+		t.Errorf("message outside the window discarded")
+	}
+}
+
+func TestHTTPBusMessagesDuplicate(t *testing.T) {
+	h := newCountHandler()
+	b := NewBus(context.Background(), h)
+	defer b.close()
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Post(s.URL+"/rex/v0/messages?wait=true", "application/json", strings.NewReader(`{
+			"session": "session-01",
+			"id": "msg-01",
+			"time": "0000010000000001",
+			"data": "slap"
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("status: %s", resp.Status)
+		}
+		if h.count("slap") != 1 {
+			t.Errorf("count: %d", h.count("slap"))
+		}
+	}
+}
+
+func TestClientAcknowledge(t *testing.T) {
+	h := newCountHandler()
+	b := NewBus(context.Background(), h)
+	defer b.close()
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.Acknowledge = true
+	err := c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		err = c.Send(context.Background(), String("slap"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.count("slap") != i {
+			t.Errorf("count: %d (!= %d)", h.count("slap"), i)
+		}
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var mut sync.Mutex
+	var attempts []time.Time
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		attempts = append(attempts, time.Now())
+		mut.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.Session = "session-01"
+	c.Retries = 2
+	c.RetryBackoff = 20 * time.Millisecond
+	err := c.Send(context.Background(), String("slap"))
+	if _, ok := err.(retryableError); !ok {
+		t.Errorf("send: %v", err)
+	}
+	mut.Lock()
+	if len(attempts) != 3 {
+		t.Fatalf("attempts: %d", len(attempts))
+	}
+	for i, min := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond} {
+		if d := attempts[i+1].Sub(attempts[i]); d < min {
+			t.Errorf("retry %d after %v (< %v)", i, d, min)
+		}
+	}
+	mut.Unlock()
+
+	// retries stop once the context is done.
+	c.Retries = 100
+	c.RetryBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.Send(ctx, String("slap"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("send: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("send returned after %v", time.Since(start))
+	}
+}
@@ -0,0 +1,123 @@
+package room
+
+import "sync"
+
+// dispatcher queues messages for a pool of workers.  Each session has its own
+// queue and at most one worker handles messages from a session at a time, so
+// they are handled in the order they were received.  A worker takes the next
+// message from whichever session has been ready longest, so a slow handler
+// only holds up the session it is handling.
+type dispatcher struct {
+	mut    sync.Mutex
+	cond   *sync.Cond
+	queues map[string][]*envelope // messages waiting by session
+	active map[string]bool        // sessions queued or being handled
+	ready  []string               // sessions waiting for a worker, oldest first
+	term   bool
+}
+
+func newDispatcher() *dispatcher {
+	d := &dispatcher{
+		queues: make(map[string][]*envelope),
+		active: make(map[string]bool),
+	}
+	d.cond = sync.NewCond(&d.mut)
+	return d
+}
+
+// startWorkers starts n goroutines which handle messages concurrently.
+func (b *Bus) startWorkers(n int) {
+	b.workers = newDispatcher()
+	for i := 0; i < n; i++ {
+		go b.work()
+	}
+	go func() {
+		<-b.term
+		b.workers.stop()
+	}()
+}
+
+func (b *Bus) work() {
+	for {
+		env, ok := b.workers.next()
+		if !ok {
+			return
+		}
+		b.handle(env)
+		b.workers.finish(env.session())
+	}
+}
+
+// dispatch queues env for the workers, or handles it immediately if b has no
+// workers.  dispatch never waits for a worker.
+func (b *Bus) dispatch(env *envelope) {
+	if b.workers == nil {
+		b.handle(env)
+		return
+	}
+	b.workers.push(env)
+}
+
+// push adds env to the queue for its session.
+func (d *dispatcher) push(env *envelope) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	session := env.session()
+	d.queues[session] = append(d.queues[session], env)
+	if !d.active[session] {
+		d.active[session] = true
+		d.ready = append(d.ready, session)
+		d.cond.Signal()
+	}
+}
+
+// next waits for a session to be ready and returns its oldest message.  next
+// returns false once the dispatcher is stopped.
+func (d *dispatcher) next() (*envelope, bool) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	for len(d.ready) == 0 && !d.term {
+		d.cond.Wait()
+	}
+	if d.term {
+		return nil, false
+	}
+	session := d.ready[0]
+	d.ready[0] = ""
+	d.ready = d.ready[1:]
+	queue := d.queues[session]
+	env := queue[0]
+	queue[0] = nil
+	d.queues[session] = queue[1:]
+	return env, true
+}
+
+// finish is called once a worker has handled a message from session.  If the
+// session has more messages it waits behind the other ready sessions.
+func (d *dispatcher) finish(session string) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if len(d.queues[session]) == 0 {
+		delete(d.queues, session)
+		delete(d.active, session)
+		return
+	}
+	d.ready = append(d.ready, session)
+	d.cond.Signal()
+}
+
+// stop wakes all waiting workers so they return.
+func (d *dispatcher) stop() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.term = true
+	d.cond.Broadcast()
+}
+
+// session returns the session env originated from.
+func (env *envelope) session() string {
+	if env.presence != nil {
+		return env.presence.Session
+	}
+	return env.msg.Session()
+}
@@ -0,0 +1,83 @@
+package room
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusWorkers(t *testing.T) {
+	var mut sync.Mutex
+	handled := make(map[string][]int)
+	release := make(chan struct{})
+	done := make(chan string, 100)
+	h := hfunc(func(ctx context.Context, msg Msg) {
+		if msg.Session() == "slow" {
+			<-release
+		}
+		n, _ := strconv.Atoi(msg.Text())
+		mut.Lock()
+		handled[msg.Session()] = append(handled[msg.Session()], n)
+		mut.Unlock()
+		done <- msg.Session()
+	})
+	b := NewBusConfig(context.Background(), &BusConfig{Workers: 2}, h)
+	defer b.close()
+
+	fast := "fast"
+	b.Message("slow", String("0"))
+	for i := 0; i < 10; i++ {
+		b.Message(fast, String(strconv.Itoa(i)))
+	}
+	for i := 0; i < 10; i++ {
+		select {
+		case session := <-done:
+			if session != fast {
+				t.Fatalf("session: %q", session)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("messages blocked by a slow session")
+		}
+	}
+	close(release)
+	<-done
+
+	mut.Lock()
+	defer mut.Unlock()
+	for i, n := range handled[fast] {
+		if n != i {
+			t.Fatalf("messages out of order: %v", handled[fast])
+		}
+	}
+}
+
+func TestBusWorkersBacklog(t *testing.T) {
+	release := make(chan struct{})
+	h := hfunc(func(ctx context.Context, msg Msg) {
+		if msg.Session() == "slow" {
+			<-release
+		}
+	})
+	b := NewBusConfig(context.Background(), &BusConfig{Workers: 1}, h)
+	defer b.close()
+	defer close(release)
+
+	// a backlog behind a blocked worker must not stop the bus accepting
+	// messages.
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		b.Message("slow", String("0"))
+		for i := 0; i < 1000; i++ {
+			b.Message("session-"+strconv.Itoa(i%10), String(strconv.Itoa(i)))
+		}
+	}()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatalf("message loop blocked by a slow session")
+	}
+}
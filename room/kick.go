@@ -0,0 +1,158 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrSessionKicked is returned when a session which has been removed from
+// the room with Kick or Ban attempts to use the Bus.
+var ErrSessionKicked = errors.New("session removed from the room")
+
+// ErrSessionBanned is returned when a client banned from the room attempts to
+// join it.
+var ErrSessionBanned = errors.New("banned from the room")
+
+// KickDuration is the amount of time requests on behalf of a session removed
+// with Kick are rejected.  Afterwards the session is forgotten.
+var KickDuration = time.Hour
+
+// banList records the sessions removed from a Bus and the addresses and
+// devices temporarily prevented from joining it again.
+type banList struct {
+	mut     sync.Mutex
+	kicked  map[string]time.Time // expiration by session
+	addrs   map[string]time.Time // expiration by address
+	devices map[string]time.Time // expiration by device
+}
+
+func newBanList() *banList {
+	return &banList{
+		kicked:  make(map[string]time.Time),
+		addrs:   make(map[string]time.Time),
+		devices: make(map[string]time.Time),
+	}
+}
+
+// kick rejects session for KickDuration, discarding the sessions whose kick
+// has expired.
+func (l *banList) kick(session string) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	for s, until := range l.kicked {
+		if !now.Before(until) {
+			delete(l.kicked, s)
+		}
+	}
+	l.kicked[session] = now.Add(KickDuration)
+}
+
+func (l *banList) isKicked(session string) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return bannedLocked(l.kicked, session, time.Now())
+}
+
+// ban prevents addr and device from joining until the given time.  Empty
+// values are ignored.
+func (l *banList) ban(addr, device string, until time.Time) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if addr != "" {
+		l.addrs[addr] = until
+	}
+	if device != "" {
+		l.devices[device] = until
+	}
+}
+
+// banned returns true if either addr or device is banned at time t.
+func (l *banList) banned(addr, device string, t time.Time) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return bannedLocked(l.addrs, addr, t) || bannedLocked(l.devices, device, t)
+}
+
+func bannedLocked(bans map[string]time.Time, key string, t time.Time) bool {
+	if key == "" {
+		return false
+	}
+	until, ok := bans[key]
+	if !ok {
+		return false
+	}
+	if !t.Before(until) {
+		delete(bans, key)
+		return false
+	}
+	return true
+}
+
+// Kick forcibly removes session from the room.  Its event subscriptions are
+// terminated with ErrSessionKicked, messages and subscriptions for the session
+// are rejected for KickDuration, its session token is revoked, it is removed from the
+// SessionRegistry, and handlers are notified that the session left.  The client
+// may create a new session unless it has been banned.
+func (b *Bus) Kick(session string) {
+	b.bans.kick(session)
+	b.regmut.Lock()
+	onKick := b.onKick
+	b.regmut.Unlock()
+	for _, fn := range onKick {
+		fn(session)
+	}
+	b.sessions.Remove(session)
+	b.eventsrdy.L.Lock()
+	for s := range b.subs[session] {
+		close(s.kicked)
+	}
+	delete(b.subs, session)
+	b.eventsrdy.Broadcast()
+	b.eventsrdy.L.Unlock()
+	b.Leave(session)
+}
+
+// notifyKick arranges for fn to be called with each session removed by Kick.
+func (b *Bus) notifyKick(fn func(session string)) {
+	b.regmut.Lock()
+	defer b.regmut.Unlock()
+	b.onKick = append(b.onKick, fn)
+}
+
+// Ban is like Kick but also prevents the address and device the session
+// joined from from joining the room again for the duration d.
+func (b *Bus) Ban(session string, d time.Duration) {
+	info, ok := b.sessions.Lookup(session)
+	if ok {
+		b.bans.ban(info.Addr, info.Device, time.Now().Add(d))
+	}
+	b.Kick(session)
+}
+
+// admit writes an error response and returns false if the client making
+// request r is banned or session has been kicked.
+func admit(b *Bus, w http.ResponseWriter, r *http.Request, session string) bool {
+	if b.bans.banned(remoteHost(r), "", time.Now()) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, jsonBanned())
+		return false
+	}
+	if session != "" && b.bans.isKicked(session) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, jsonKicked())
+		return false
+	}
+	return true
+}
+
+func jsonKicked() string {
+	return jsonError("session_kicked", ErrSessionKicked.Error())
+}
+
+func jsonBanned() string {
+	return jsonError("session_banned", ErrSessionBanned.Error())
+}
@@ -0,0 +1,153 @@
+package room
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusKick(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	sub := b.SubscribeAs("s1", 0)
+	other := b.SubscribeAs("s2", 0)
+	defer b.Unsubscribe(other)
+
+	b.Kick("s1")
+	if sub.Next(time.After(time.Second)) {
+		t.Errorf("event received after kick")
+	}
+	if sub.Err() != ErrSessionKicked {
+		t.Errorf("subscription error: %v", sub.Err())
+	}
+	b.Unsubscribe(sub)
+
+	err := b.Message("s1", String("hello"))
+	if err != ErrSessionKicked {
+		t.Errorf("message error: %v", err)
+	}
+	sub = b.SubscribeAs("s1", 0)
+	if sub.Err() != ErrSessionKicked {
+		t.Errorf("subscription error: %v", sub.Err())
+	}
+	b.Unsubscribe(sub)
+
+	b.Event(String("hello"))
+	if !other.Next(time.After(time.Second)) {
+		t.Errorf("event not received by another session")
+	}
+	err = b.Message("s2", String("hello"))
+	if err != nil {
+		t.Errorf("message error: %v", err)
+	}
+}
+
+func TestBusBan(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.Device = "device-01"
+	err := c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.Run(context.Background(), 0)
+		errc <- err
+	}()
+	for len(b.Presence()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Ban(c.Session, time.Minute)
+	select {
+	case err := <-errc:
+		if err != ErrSessionKicked {
+			t.Errorf("run error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("client not disconnected")
+	}
+
+	err = c.Send(context.Background(), String("hello"))
+	if err == nil {
+		t.Errorf("message sent by a kicked session")
+	}
+
+	c = testClient(t, s, nil)
+	c.Device = "device-01"
+	err = c.CreateSession(context.Background(), "player")
+	if err != ErrSessionBanned {
+		t.Errorf("create session error: %v", err)
+	}
+}
+
+func TestBusKickRevokesToken(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	auth, err := newJoinAuth(&JoinPolicy{Code: "1234"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(newHTTPBus(b, auth, nil))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.JoinCode = "1234"
+	err = c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.Sessions().Lookup(c.Session); !ok {
+		t.Fatalf("session not registered")
+	}
+
+	b.Kick(c.Session)
+	if _, ok := b.Sessions().Lookup(c.Session); ok {
+		t.Errorf("kicked session still registered")
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/rex/v0/events?session="+c.Session, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		t.Errorf("reconnect with revoked token: %s", resp.Status)
+	}
+}
+
+func TestBanListKickExpires(t *testing.T) {
+	defer func(d time.Duration) { KickDuration = d }(KickDuration)
+	KickDuration = 50 * time.Millisecond
+
+	l := newBanList()
+	l.kick("s1")
+	if !l.isKicked("s1") {
+		t.Errorf("session not kicked")
+	}
+	time.Sleep(100 * time.Millisecond)
+	l.kick("s2")
+	if len(l.kicked) != 1 {
+		t.Errorf("kicked sessions: %v", l.kicked)
+	}
+	if l.isKicked("s1") {
+		t.Errorf("kick did not expire")
+	}
+}
@@ -0,0 +1,280 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrRateLimited is the reason a call fails when it is rejected by the
+// RateLimit middleware.
+var ErrRateLimited = errors.New("too many messages from session")
+
+// RejectedError is returned when a sender waits for a message which was
+// rejected by middleware, such as Validate or RateLimit, instead of being
+// handled.
+type RejectedError struct {
+	Reason string
+}
+
+func (err *RejectedError) Error() string {
+	return "message rejected: " + err.Reason
+}
+
+// Middleware wraps a Handler to add behavior around the handling of messages.
+// A Middleware may handle a message itself instead of passing it on to the
+// wrapped Handler.
+type Middleware func(Handler) Handler
+
+// handlerList is a Handler passing messages to each of its handlers in turn.
+type handlerList []Handler
+
+func (l handlerList) HandleMessage(ctx context.Context, msg Msg) {
+	for _, h := range l {
+		handleMessage(ctx, h, msg)
+	}
+}
+
+// handleMessage passes msg to h.  If the Recover middleware is in use a panic
+// in h is recovered so that msg is still passed to later handlers.
+func handleMessage(ctx context.Context, h Handler, msg Msg) {
+	if recovering(ctx) {
+		defer recoverMessage(ctx, msg)
+	}
+	h.HandleMessage(ctx, msg)
+}
+
+// Use adds middleware around b's message handlers.  The first middleware
+// given is the outermost, receiving messages before any others.  Middleware
+// applies to messages and calls, including handlers added later with
+// AddHandler, but not to presence changes.  Recover is the exception, see its
+// documentation.
+func (b *Bus) Use(mw ...Middleware) {
+	b.regmut.Lock()
+	defer b.regmut.Unlock()
+	b.middleware = append(b.middleware, mw...)
+	b.chainLocked()
+}
+
+// chainLocked wraps b.handlers with b.middleware.  The caller must hold
+// b.regmut.
+func (b *Bus) chainLocked() {
+	handlers := make(handlerList, len(b.handlers))
+	for i, r := range b.handlers {
+		handlers[i] = r.h
+	}
+	var h Handler = handlers
+	b.recovers = false
+	for i := len(b.middleware) - 1; i >= 0; i-- {
+		h = b.middleware[i](h)
+		if _, ok := h.(*recoverHandler); ok {
+			b.recovers = true
+		}
+	}
+	b.handler = h
+}
+
+// reject fails the call being handled with ctx, so the client is not left
+// waiting for the call to time out.  A rejected message is instead forgotten
+// by the bus, so a retry is handled again, and a sender waiting for it
+// receives a *RejectedError.
+func reject(ctx context.Context, err error) {
+	if IsCall(ctx) {
+		ReplyError(ctx, err)
+		return
+	}
+	rejectMessage(ctx, err)
+}
+
+// rejectMessage marks the message being handled with ctx as rejected for the
+// reason err.  Calls are unaffected.
+func rejectMessage(ctx context.Context, err error) {
+	if env, ok := ctx.Value(envelopeContextKey{}).(*envelope); ok {
+		env.err = &RejectedError{err.Error()}
+	}
+}
+
+// Recover returns Middleware which recovers from panics in handlers and
+// middleware.  The panic is logged along with the stack of the handler and the
+// message is rejected, failing a call being handled.  A panicking handler does
+// not prevent the message being passed to later handlers, and later messages
+// are handled normally.  Unlike other middleware Recover also applies to the
+// presence changes passed to handlers, whose panics are only logged.
+func Recover() Middleware {
+	return func(h Handler) Handler {
+		return &recoverHandler{h}
+	}
+}
+
+type recoverContextKey struct{}
+
+// withRecover returns a context under which handlers recover from panics.
+func withRecover(ctx context.Context) context.Context {
+	return context.WithValue(ctx, recoverContextKey{}, true)
+}
+
+// recovering returns true if handlers called with ctx must recover from
+// panics.
+func recovering(ctx context.Context) bool {
+	ok, _ := ctx.Value(recoverContextKey{}).(bool)
+	return ok
+}
+
+// recoverHandler is the Handler returned by the Recover middleware.
+type recoverHandler struct {
+	h Handler
+}
+
+func (r *recoverHandler) HandleMessage(ctx context.Context, msg Msg) {
+	defer recoverMessage(ctx, msg)
+	r.h.HandleMessage(withRecover(ctx), msg)
+}
+
+// recoverMessage must be deferred.  It recovers from a panic handling msg and
+// rejects msg.
+func recoverMessage(ctx context.Context, msg Msg) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	log.Printf("[ERR] Panic handling message from session %q: %v\n%s", msg.Session(), v, panicStack())
+	reject(ctx, fmt.Errorf("internal error"))
+}
+
+// recoverPresence must be deferred.  It recovers from a panic handling change.
+func recoverPresence(change PresenceChange) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	log.Printf("[ERR] Panic handling presence change %v of session %q: %v\n%s", change.Kind, change.Session, v, panicStack())
+}
+
+// panicStack returns the stack of the current goroutine.
+func panicStack() []byte {
+	stack := make([]byte, 4096)
+	return stack[:runtime.Stack(stack, false)]
+}
+
+// Logging returns Middleware which logs each message along with the time
+// taken to handle it.  If logger is nil the standard logger is used.
+func Logging(logger *log.Logger) Middleware {
+	logf := log.Printf
+	if logger != nil {
+		logf = logger.Printf
+	}
+	return func(h Handler) Handler {
+		return hfunc(func(ctx context.Context, msg Msg) {
+			start := time.Now()
+			h.HandleMessage(ctx, msg)
+			logf("[INFO] Handled message from session %q on topic %q in %v", msg.Session(), msg.Topic(), time.Since(start))
+		})
+	}
+}
+
+// Validate returns Middleware which passes on only the messages for which fn
+// returns nil.  Invalid messages are logged and dropped, and invalid calls
+// fail with the reason given by the error, as do senders waiting for an
+// invalid message.
+func Validate(fn func(Msg) error) Middleware {
+	return func(h Handler) Handler {
+		return hfunc(func(ctx context.Context, msg Msg) {
+			err := fn(msg)
+			if err != nil {
+				log.Printf("[INFO] Rejected invalid message from session %q: %v", msg.Session(), err)
+				reject(ctx, err)
+				return
+			}
+			h.HandleMessage(ctx, msg)
+		})
+	}
+}
+
+// RateLimit returns Middleware which limits each session to n messages per
+// period.  A session may send up to n messages in a burst, after which
+// messages are accepted at an even rate.  Messages over the limit are
+// dropped and calls over the limit fail with ErrRateLimited, as do senders
+// waiting for a message over the limit.  Messages without a session are not
+// limited.
+func RateLimit(n int, per time.Duration) Middleware {
+	limiter := newRateLimiter(n, per)
+	return func(h Handler) Handler {
+		return hfunc(func(ctx context.Context, msg Msg) {
+			if msg.Session() != "" && !limiter.allow(msg.Session(), time.Now()) {
+				reject(ctx, ErrRateLimited)
+				return
+			}
+			h.HandleMessage(ctx, msg)
+		})
+	}
+}
+
+// rateLimiter is a token bucket for each session.
+type rateLimiter struct {
+	mut     sync.Mutex
+	burst   float64
+	rate    float64 // tokens per second
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(n int, per time.Duration) *rateLimiter {
+	if n <= 0 {
+		n = 1
+	}
+	if per <= 0 {
+		per = time.Second
+	}
+	return &rateLimiter{
+		burst:   float64(n),
+		rate:    float64(n) / per.Seconds(),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow returns true if session may send a message at time t.
+func (l *rateLimiter) allow(session string, t time.Time) bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	l.sweepLocked(t)
+	b, ok := l.buckets[session]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: t}
+		l.buckets[session] = b
+	}
+	b.tokens += t.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = t
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweepLocked forgets the buckets which have refilled, since they are no
+// different from new ones.  The caller must hold l.mut.
+func (l *rateLimiter) sweepLocked(t time.Time) {
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if t.Sub(l.swept) < full {
+		return
+	}
+	l.swept = t
+	for session, b := range l.buckets {
+		if t.Sub(b.last) >= full {
+			delete(l.buckets, session)
+		}
+	}
+}
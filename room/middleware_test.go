@@ -0,0 +1,197 @@
+package room
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusUse(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return hfunc(func(ctx context.Context, msg Msg) {
+				order = append(order, name)
+				h.HandleMessage(ctx, msg)
+			})
+		}
+	}
+	b := NewBus(context.Background())
+	defer b.close()
+	b.Use(tag("outer"), tag("inner"))
+	b.AddHandler(hfunc(func(ctx context.Context, msg Msg) {
+		order = append(order, "handler")
+	}))
+
+	err := b.Deliver(context.Background(), &Delivery{Session: "s", Content: String("hi"), Wait: true})
+	if err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if fmt.Sprint(order) != "[outer inner handler]" {
+		t.Errorf("order: %v", order)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	h := hfunc(func(ctx context.Context, msg Msg) {
+		if msg.Text() == "panic" {
+			panic("handler failed")
+		}
+		Reply(ctx, msg)
+	})
+	b := NewBus(context.Background(), h)
+	defer b.close()
+	b.Use(Recover())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := b.Call(ctx, "s", String("panic"))
+	if _, ok := err.(*CallError); !ok {
+		t.Fatalf("error: %v", err)
+	}
+	reply, err := b.Call(ctx, "s", String("ok"))
+	if err != nil {
+		t.Fatalf("call after panic: %v", err)
+	}
+	if reply.Text() != "ok" {
+		t.Errorf("reply: %q", reply.Text())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	handled := 0
+	h := hfunc(func(ctx context.Context, msg Msg) {
+		handled++
+		Reply(ctx, msg)
+	})
+	b := NewBus(context.Background(), h)
+	defer b.close()
+	b.Use(Validate(func(msg Msg) error {
+		if msg.Text() == "" {
+			return fmt.Errorf("empty message")
+		}
+		return nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := b.Call(ctx, "s", String(""))
+	if err, ok := err.(*CallError); !ok || err.Reason != "empty message" {
+		t.Fatalf("error: %v", err)
+	}
+	_, err = b.Call(ctx, "s", String("move"))
+	if err != nil {
+		t.Fatalf("valid call: %v", err)
+	}
+	if handled != 1 {
+		t.Errorf("handled: %d", handled)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Second)
+	t0 := time.Now()
+	for i, test := range []struct {
+		session string
+		t       time.Time
+		allow   bool
+	}{
+		{"a", t0, true},
+		{"a", t0, true},
+		{"a", t0, false},
+		{"b", t0, true},
+		{"a", t0.Add(250 * time.Millisecond), false},
+		{"a", t0.Add(500 * time.Millisecond), true},
+		{"a", t0.Add(500 * time.Millisecond), false},
+		{"a", t0.Add(10 * time.Second), true},
+		{"a", t0.Add(10 * time.Second), true},
+		{"a", t0.Add(10 * time.Second), false},
+	} {
+		allow := l.allow(test.session, test.t)
+		if allow != test.allow {
+			t.Errorf("test %d: allow %v", i, allow)
+		}
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("buckets not swept: %d", len(l.buckets))
+	}
+}
+
+func TestValidateWait(t *testing.T) {
+	handled := make(chan string, 2)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		handled <- msg.Text()
+	}))
+	defer b.close()
+	b.Use(Validate(func(msg Msg) error {
+		if msg.Text() == "" {
+			return fmt.Errorf("empty message")
+		}
+		return nil
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := b.Deliver(ctx, &Delivery{Session: "s", Content: String(""), ID: "1", Wait: true})
+	if err, ok := err.(*RejectedError); !ok || err.Reason != "empty message" {
+		t.Fatalf("error: %v", err)
+	}
+
+	// the rejected message is forgotten so it may be retried.
+	err = b.Deliver(ctx, &Delivery{Session: "s", Content: String("move"), ID: "1", Wait: true})
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if text := <-handled; text != "move" {
+		t.Errorf("handled: %q", text)
+	}
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+	c := testClient(t, s, nil)
+	c.Session = "s"
+	c.Acknowledge = true
+	err = c.Send(ctx, String(""))
+	if err, ok := err.(*RejectedError); !ok || err.Reason != "empty message" {
+		t.Errorf("send: %v", err)
+	}
+}
+
+// panicPresence is a PresenceHandler which panics on every message and
+// presence change.
+type panicPresence struct{}
+
+func (panicPresence) HandleMessage(ctx context.Context, msg Msg) {
+	panic("handler failed")
+}
+
+func (panicPresence) HandlePresence(ctx context.Context, change PresenceChange) {
+	panic("handler failed")
+}
+
+func TestRecoverEachHandler(t *testing.T) {
+	msgs := make(chan string, 1)
+	changes := make(presenceRecorder, 10)
+	b := NewBus(context.Background(), panicPresence{}, changes, hfunc(func(ctx context.Context, msg Msg) {
+		msgs <- msg.Text()
+	}))
+	defer b.close()
+	b.Use(Recover())
+
+	err := b.Deliver(context.Background(), &Delivery{Session: "s", Content: String("hello"), Wait: true})
+	if _, ok := err.(*RejectedError); !ok {
+		t.Errorf("error: %v", err)
+	}
+	select {
+	case text := <-msgs:
+		if text != "hello" {
+			t.Errorf("message: %q", text)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not passed to later handler")
+	}
+	changes.expect(t, "s", PresenceJoin)
+}
@@ -0,0 +1,257 @@
+package room
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultSyncInterval is the time between clock measurements made by
+// SyncClock when no interval is given.
+var DefaultSyncInterval = 5 * time.Second
+
+// clockSamples is the number of recent measurements from which a client
+// estimates the server clock.
+const clockSamples = 8
+
+// ClockSample is a measurement of the server clock made by a client.
+type ClockSample struct {
+	// RTT is the round-trip time of the measurement, excluding the time
+	// spent by the server.
+	RTT time.Duration
+
+	// Offset is the difference between the server clock and the client
+	// clock.  It is positive when the server clock is ahead.
+	Offset time.Duration
+}
+
+// newClockSample computes a measurement in the manner of NTP from the times
+// the client sent a ping and received the reply, and the times the server
+// received the ping and replied to it.  The server times have millisecond
+// precision, so the round-trip time of a fast ping may come out negative, in
+// which case it is taken to be zero.
+func newClockSample(sent, recv, srecv, ssent time.Time) ClockSample {
+	sample := ClockSample{
+		RTT:    recv.Sub(sent) - ssent.Sub(srecv),
+		Offset: (srecv.Sub(sent) + ssent.Sub(recv)) / 2,
+	}
+	if sample.RTT < 0 {
+		sample.RTT = 0
+	}
+	return sample
+}
+
+// clockEstimate tracks recent measurements of a remote clock.  The
+// measurement with the smallest round-trip time is the most accurate, because
+// the least time is unaccounted for.
+type clockEstimate struct {
+	mut     sync.Mutex
+	samples []ClockSample
+}
+
+func (e *clockEstimate) add(sample ClockSample) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.samples = append(e.samples, sample)
+	if len(e.samples) > clockSamples {
+		e.samples = e.samples[len(e.samples)-clockSamples:]
+	}
+}
+
+// best returns the most accurate recent measurement.
+func (e *clockEstimate) best() (ClockSample, bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	if len(e.samples) == 0 {
+		return ClockSample{}, false
+	}
+	best := e.samples[0]
+	for _, sample := range e.samples[1:] {
+		if sample.RTT < best.RTT {
+			best = sample
+		}
+	}
+	return best, true
+}
+
+// shift returns t moved by offset.
+func shift(t Time, offset time.Duration) Time {
+	if t.IsZero() {
+		return t
+	}
+	t.Wall += int64(offset / time.Millisecond)
+	return t
+}
+
+// millis returns t in milliseconds since the Unix epoch.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis returns the time ms milliseconds after the Unix epoch.
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// jsonPing is a ping sent to /rex/v0/ping.  The client reports its current
+// estimate of the server clock, if it has one, so the server can translate
+// the times of its messages.
+type jsonPing struct {
+	S      string `json:"session,omitempty"`
+	T      int64  `json:"time"`
+	Offset *int64 `json:"offset,omitempty"`
+	RTT    *int64 `json:"rtt,omitempty"`
+}
+
+// jsonPong is the reply to a ping.  All times are milliseconds since the Unix
+// epoch.
+type jsonPong struct {
+	T        int64 `json:"time"`
+	Received int64 `json:"received"`
+	Sent     int64 `json:"sent"`
+}
+
+func busPingHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		received := time.Now()
+		defer r.Body.Close()
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("POST"))
+			return
+		}
+
+		var ping jsonPing
+		err := json.NewDecoder(r.Body).Decode(&ping)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("http_request_invalid", "could not read a complete entity"))
+			return
+		}
+		if ping.S != "" && ping.Offset != nil && ping.RTT != nil {
+			if !auth.authorize(w, r, ping.S) {
+				return
+			}
+			b.sessions.seenFrom(ping.S, remoteHost(r))
+			b.sessions.setClock(ping.S, ClockSample{
+				Offset: time.Duration(*ping.Offset) * time.Millisecond,
+				RTT:    time.Duration(*ping.RTT) * time.Millisecond,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&jsonPong{
+			T:        ping.T,
+			Received: millis(received),
+			Sent:     millis(time.Now()),
+		})
+	}
+}
+
+// Translate returns the time of msg in the timeline of the bus clock, using
+// the clock offset last reported by the session which sent msg.  If the
+// session has not reported an offset the time of msg is returned unchanged.
+func (b *Bus) Translate(msg Msg) Time {
+	return shift(msg.Time(), b.sessions.clockOffset(msg.Session()))
+}
+
+// Translate returns the time of msg in the timeline of the clock of the Bus
+// associated with ctx, allowing handlers to compare when players acted.
+func Translate(ctx context.Context, msg Msg) Time {
+	b := contextBus(ctx)
+	if b == nil {
+		return msg.Time()
+	}
+	return b.Translate(msg)
+}
+
+// Ping measures the round-trip time to the server and the offset of the
+// server clock.  The measurement is included in the estimate returned by
+// ClockOffset.  Ping also reports the client's current estimate to the server
+// so that it can translate the times of messages sent by c.Session.
+func (c *Client) Ping(ctx context.Context) (ClockSample, error) {
+	ping := &jsonPing{S: c.Session}
+	if est, ok := c.sync.best(); ok {
+		offset := int64(est.Offset / time.Millisecond)
+		rtt := int64(est.RTT / time.Millisecond)
+		ping.Offset, ping.RTT = &offset, &rtt
+	}
+	sent := time.Now()
+	ping.T = millis(sent)
+	body, err := json.Marshal(ping)
+	if err != nil {
+		return ClockSample{}, err
+	}
+	req, err := http.NewRequest("POST", c.url("/rex/v0/ping"), bytes.NewReader(body))
+	if err != nil {
+		return ClockSample{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Cancel = ctx.Done()
+	resp, err := c.do(req)
+	recv := time.Now()
+	if err != nil {
+		return ClockSample{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body jsonErrorBody
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil || body.ID == "" {
+			return ClockSample{}, fmt.Errorf("%v %s %s", resp.Status, "POST", c.url("/rex/v0/ping"))
+		}
+		return ClockSample{}, body.err()
+	}
+	var pong jsonPong
+	err = json.NewDecoder(resp.Body).Decode(&pong)
+	if err != nil {
+		return ClockSample{}, err
+	}
+	sample := newClockSample(sent, recv, fromMillis(pong.Received), fromMillis(pong.Sent))
+	c.sync.add(sample)
+	return sample, nil
+}
+
+// ClockOffset returns the client's estimate of the server clock based on
+// recent calls to Ping.  If Ping has not succeeded ClockOffset returns false.
+func (c *Client) ClockOffset() (ClockSample, bool) {
+	return c.sync.best()
+}
+
+// SyncClock calls Ping every interval until ctx is done, continuously
+// estimating the server clock.  If interval is zero DefaultSyncInterval is
+// used.  Failed measurements are logged and retried at the next interval.
+func (c *Client) SyncClock(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_, err := c.Ping(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[INFO] Failed to measure server clock: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// observe merges t, the time of an event or snapshot from the server, into
+// the client clock.  The time is first translated into the client's timeline
+// so a server clock far ahead of the client does not drag the client clock
+// with it.
+func (c *Client) observe(t Time) {
+	est, _ := c.sync.best()
+	c.clock.Update(shift(t, -est.Offset))
+}
@@ -0,0 +1,132 @@
+package room
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestClockSample(t *testing.T) {
+	t0 := time.Unix(1453520000, 0)
+	ms := func(n int) time.Time { return t0.Add(time.Duration(n) * time.Millisecond) }
+
+	// the server clock is 1000ms ahead, each leg of the trip takes 20ms
+	// and the server spends 5ms handling the ping.
+	sample := newClockSample(ms(0), ms(45), ms(1020), ms(1025))
+	if sample.RTT != 40*time.Millisecond {
+		t.Errorf("rtt: %v", sample.RTT)
+	}
+	if sample.Offset != 1000*time.Millisecond {
+		t.Errorf("offset: %v", sample.Offset)
+	}
+
+	// millisecond server times can make a fast round trip negative.
+	sample = newClockSample(ms(0), ms(0).Add(300*time.Microsecond), ms(1000), ms(1001))
+	if sample.RTT != 0 {
+		t.Errorf("rtt: %v", sample.RTT)
+	}
+}
+
+func TestClockEstimate(t *testing.T) {
+	var e clockEstimate
+	_, ok := e.best()
+	if ok {
+		t.Errorf("estimate without samples")
+	}
+	e.add(ClockSample{RTT: 30 * time.Millisecond, Offset: 15 * time.Millisecond})
+	e.add(ClockSample{RTT: 10 * time.Millisecond, Offset: 5 * time.Millisecond})
+	e.add(ClockSample{RTT: 50 * time.Millisecond, Offset: 25 * time.Millisecond})
+	best, ok := e.best()
+	if !ok || best.Offset != 5*time.Millisecond {
+		t.Errorf("best: %v", best)
+	}
+
+	// old samples are forgotten.
+	for i := 0; i < clockSamples; i++ {
+		e.add(ClockSample{RTT: 20 * time.Millisecond})
+	}
+	best, _ = e.best()
+	if best.RTT != 20*time.Millisecond {
+		t.Errorf("best: %v", best)
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	ctx := context.Background()
+	err := c.CreateSession(ctx, "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := c.ClockOffset()
+	if ok {
+		t.Errorf("offset before ping")
+	}
+	for i := 0; i < 2; i++ {
+		sample, err := c.Ping(ctx)
+		if err != nil {
+			t.Fatalf("ping: %v", err)
+		}
+		if sample.RTT < 0 || sample.RTT > time.Second {
+			t.Errorf("rtt: %v", sample.RTT)
+		}
+		if sample.Offset < -time.Second || sample.Offset > time.Second {
+			t.Errorf("offset: %v", sample.Offset)
+		}
+	}
+	_, ok = c.ClockOffset()
+	if !ok {
+		t.Errorf("no offset after ping")
+	}
+
+	// the first ping's estimate was reported with the second.
+	info, ok := b.Sessions().Lookup(c.Session)
+	if !ok {
+		t.Fatalf("session not registered")
+	}
+	if info.Clock.RTT > time.Second {
+		t.Errorf("reported clock: %v", info.Clock)
+	}
+
+	// sessions chosen by older clients are registered by their pings.
+	c = testClient(t, s, nil)
+	c.Session = "legacy-session"
+	for i := 0; i < 2; i++ {
+		_, err := c.Ping(ctx)
+		if err != nil {
+			t.Fatalf("ping: %v", err)
+		}
+	}
+	if _, ok := b.Sessions().Lookup(c.Session); !ok {
+		t.Fatalf("session not registered by ping")
+	}
+	if b.sessions.clockOffset(c.Session) != c.sync.samples[0].Offset/time.Millisecond*time.Millisecond {
+		t.Errorf("offset not recorded: %v", b.sessions.clockOffset(c.Session))
+	}
+}
+
+func TestBusTranslate(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	info := b.Sessions().Create("player", nil)
+	b.Sessions().setClock(info.ID, ClockSample{Offset: 2 * time.Second})
+
+	sent := Time{Wall: 1453520000000, Logical: 3}
+	msg := newMsg(info.ID, String("slap"), func() Time { return sent })
+	translated := b.Translate(msg)
+	if translated != (Time{Wall: 1453520002000, Logical: 3}) {
+		t.Errorf("translated: %v", translated)
+	}
+
+	msg = newMsg("unknown", String("slap"), func() Time { return sent })
+	if b.Translate(msg) != sent {
+		t.Errorf("translated: %v", b.Translate(msg))
+	}
+}
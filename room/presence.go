@@ -0,0 +1,296 @@
+package room
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultIdleTimeout is the IdleTimeout used by a Bus when none is
+// configured.
+var DefaultIdleTimeout = 30 * time.Second
+
+// PresenceKind identifies a change in the presence of a session.
+type PresenceKind int
+
+// Changes in the presence of a session reported to a PresenceHandler.
+const (
+	// PresenceJoin is reported when a session is first seen, or seen again
+	// after leaving.
+	PresenceJoin PresenceKind = iota
+
+	// PresenceIdle is reported when a session has no open subscriptions
+	// and has not sent a message within the bus IdleTimeout.  Typically
+	// the client's device has gone to sleep or lost its connection.
+	PresenceIdle
+
+	// PresenceActive is reported when an idle session is seen again.
+	PresenceActive
+
+	// PresenceLeave is reported when a session leaves the room, either by
+	// request or after being idle for the bus LeaveTimeout.
+	PresenceLeave
+)
+
+func (k PresenceKind) String() string {
+	switch k {
+	case PresenceJoin:
+		return "join"
+	case PresenceIdle:
+		return "idle"
+	case PresenceActive:
+		return "active"
+	case PresenceLeave:
+		return "leave"
+	default:
+		return "unknown"
+	}
+}
+
+// PresenceChange is a change in the presence of a session.
+type PresenceChange struct {
+	Session string
+	Kind    PresenceKind
+	Time    time.Time
+}
+
+// PresenceHandler is a Handler which is notified of changes in the presence
+// of sessions.  Notifications are delivered in order with the messages sent
+// by the session, so a handler sees PresenceJoin before the first message of
+// a session.
+type PresenceHandler interface {
+	Handler
+	HandlePresence(ctx context.Context, change PresenceChange)
+}
+
+// SessionPresence describes a session present on a Bus.
+type SessionPresence struct {
+	Session string
+
+	// Idle is true if the session has no open subscriptions and has not
+	// sent a message within the bus IdleTimeout.
+	Idle bool
+
+	// Subscriptions is the number of open subscriptions for the session.
+	Subscriptions int
+
+	// LastSeen is the time the session last sent a message, opened a
+	// subscription or closed one.
+	LastSeen time.Time
+}
+
+type presenceState struct {
+	subs int
+	seen time.Time
+	idle bool
+}
+
+// presenceTracker tracks the subscriptions and message activity of each
+// session and determines when sessions join, become idle and leave.
+type presenceTracker struct {
+	mut      sync.Mutex
+	sessions map[string]*presenceState
+	idle     time.Duration
+	leave    time.Duration
+}
+
+func newPresenceTracker(idle, leave time.Duration) *presenceTracker {
+	if idle <= 0 {
+		idle = DefaultIdleTimeout
+	}
+	return &presenceTracker{
+		sessions: make(map[string]*presenceState),
+		idle:     idle,
+		leave:    leave,
+	}
+}
+
+// seen records activity by session at time t, adding delta to the number of
+// open subscriptions.  If the session was absent or idle the resulting change
+// is returned.
+func (p *presenceTracker) seen(session string, delta int, t time.Time) (change PresenceChange, ok bool) {
+	if session == "" {
+		return change, false
+	}
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	state, present := p.sessions[session]
+	if !present {
+		if delta < 0 {
+			// the session left while a subscription was open.
+			return change, false
+		}
+		state = &presenceState{}
+		p.sessions[session] = state
+	}
+	state.subs += delta
+	if state.subs < 0 {
+		// a subscription opened before the session last left was closed.
+		state.subs = 0
+	}
+	state.seen = t
+	switch {
+	case !present:
+		return PresenceChange{session, PresenceJoin, t}, true
+	case state.idle:
+		state.idle = false
+		return PresenceChange{session, PresenceActive, t}, true
+	}
+	return change, false
+}
+
+// remove removes session, returning false if it was not present.
+func (p *presenceTracker) remove(session string) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	_, ok := p.sessions[session]
+	delete(p.sessions, session)
+	return ok
+}
+
+// present returns true if session is present, including when idle.
+func (p *presenceTracker) present(session string) bool {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	_, ok := p.sessions[session]
+	return ok
+}
+
+// expire returns the changes for sessions which have become idle or left at
+// time t.
+func (p *presenceTracker) expire(t time.Time) []PresenceChange {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	var changes []PresenceChange
+	for session, state := range p.sessions {
+		if state.subs > 0 {
+			continue
+		}
+		inactive := t.Sub(state.seen)
+		if p.leave > 0 && inactive >= p.leave {
+			delete(p.sessions, session)
+			changes = append(changes, PresenceChange{session, PresenceLeave, t})
+			continue
+		}
+		if !state.idle && inactive >= p.idle {
+			state.idle = true
+			changes = append(changes, PresenceChange{session, PresenceIdle, t})
+		}
+	}
+	return changes
+}
+
+func (p *presenceTracker) presence() []SessionPresence {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	var sessions []SessionPresence
+	for session, state := range p.sessions {
+		sessions = append(sessions, SessionPresence{
+			Session:       session,
+			Idle:          state.idle,
+			Subscriptions: state.subs,
+			LastSeen:      state.seen,
+		})
+	}
+	sort.Sort(presenceBySession(sessions))
+	return sessions
+}
+
+type presenceBySession []SessionPresence
+
+func (s presenceBySession) Len() int           { return len(s) }
+func (s presenceBySession) Less(i, j int) bool { return s[i].Session < s[j].Session }
+func (s presenceBySession) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Presence returns the sessions present on b, including idle sessions,
+// ordered by session identifier.
+func (b *Bus) Presence() []SessionPresence {
+	return b.presence.presence()
+}
+
+// Leave removes session from the sessions present on b.  Handlers are
+// notified with PresenceLeave if the session was present.  Leave may be called
+// by handlers, in which case the notification is delivered after the handler
+// returns.
+func (b *Bus) Leave(session string) {
+	if b.presence.remove(session) {
+		go b.notifyPresence(PresenceChange{session, PresenceLeave, time.Now()})
+	}
+}
+
+// forget releases the state b keeps for session once handlers have been
+// notified that it left.  Nothing is released if the session has returned
+// since, and its private event log is kept while it has subscriptions.
+func (b *Bus) forget(session string) {
+	if b.presence.present(session) {
+		return
+	}
+	b.dedup.forget(session)
+	b.eventsrdy.L.Lock()
+	defer b.eventsrdy.L.Unlock()
+	select {
+	case <-b.term:
+		// the stores are closed by b.eventLoop.
+		return
+	default:
+	}
+	elog, ok := b.private[session]
+	if !ok || len(b.subs[session]) > 0 {
+		return
+	}
+	delete(b.private, session)
+	err := elog.events.Close()
+	if err != nil {
+		log.Printf("[ERR] Failed to close private event store for session %q: %v", session, err)
+	}
+}
+
+// seen records activity by session, notifying handlers if the session joined
+// or is no longer idle.
+func (b *Bus) seen(session string, delta int) {
+	t := time.Now()
+	b.sessions.touch(session, t)
+	change, ok := b.presence.seen(session, delta, t)
+	if ok {
+		b.notifyPresence(change)
+	}
+}
+
+// notifyPresence passes change to handlers through the message loop so that
+// they observe it in order with the messages of the session.
+func (b *Bus) notifyPresence(change PresenceChange) {
+	b.send(context.Background(), &envelope{presence: &change})
+}
+
+// presenceLoop periodically notifies handlers of sessions which have become
+// idle or left until b terminates.
+func (b *Bus) presenceLoop() {
+	interval := b.presence.idle / 4
+	if b.presence.leave > 0 && b.presence.leave/4 < interval {
+		interval = b.presence.leave / 4
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.term:
+			return
+		case t := <-ticker.C:
+			for _, change := range b.presence.expire(t) {
+				b.notifyPresence(change)
+			}
+		}
+	}
+}
+
+// Presence returns the sessions present on the Bus associated with ctx.
+func Presence(ctx context.Context) []SessionPresence {
+	b := contextBus(ctx)
+	if b == nil {
+		return nil
+	}
+	return b.Presence()
+}
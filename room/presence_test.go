@@ -0,0 +1,118 @@
+package room
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// presenceRecorder is a PresenceHandler which passes presence changes to a
+// channel.
+type presenceRecorder chan PresenceChange
+
+func (r presenceRecorder) HandleMessage(ctx context.Context, msg Msg) {}
+
+func (r presenceRecorder) HandlePresence(ctx context.Context, change PresenceChange) {
+	r <- change
+}
+
+func (r presenceRecorder) expect(t *testing.T, session string, kind PresenceKind) {
+	select {
+	case change := <-r:
+		if change.Session != session || change.Kind != kind {
+			t.Errorf("presence: %s %v (!= %s %v)", change.Session, change.Kind, session, kind)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("presence: no change (expected %s %v)", session, kind)
+	}
+}
+
+func TestBusPresence(t *testing.T) {
+	changes := make(presenceRecorder, 10)
+	config := &BusConfig{
+		IdleTimeout:  50 * time.Millisecond,
+		LeaveTimeout: 200 * time.Millisecond,
+	}
+	b := NewBusConfig(context.Background(), config, changes)
+	defer b.close()
+
+	b.Message("s1", String("hello"))
+	changes.expect(t, "s1", PresenceJoin)
+	changes.expect(t, "s1", PresenceIdle)
+	presence := b.Presence()
+	if len(presence) != 1 || presence[0].Session != "s1" || !presence[0].Idle {
+		t.Errorf("presence: %#v", presence)
+	}
+
+	b.Message("s1", String("hello"))
+	changes.expect(t, "s1", PresenceActive)
+	changes.expect(t, "s1", PresenceIdle)
+	changes.expect(t, "s1", PresenceLeave)
+	if len(b.Presence()) != 0 {
+		t.Errorf("presence: %#v", b.Presence())
+	}
+}
+
+func TestBusPresenceSubscription(t *testing.T) {
+	changes := make(presenceRecorder, 10)
+	config := &BusConfig{IdleTimeout: 50 * time.Millisecond}
+	b := NewBusConfig(context.Background(), config, changes)
+	defer b.close()
+
+	sub := b.SubscribeAs("s1", 0)
+	changes.expect(t, "s1", PresenceJoin)
+	time.Sleep(100 * time.Millisecond)
+	presence := b.Presence()
+	if len(presence) != 1 || presence[0].Idle || presence[0].Subscriptions != 1 {
+		t.Errorf("presence: %#v", presence)
+	}
+
+	b.Unsubscribe(sub)
+	changes.expect(t, "s1", PresenceIdle)
+
+	b.Leave("s1")
+	changes.expect(t, "s1", PresenceLeave)
+	b.Leave("s1")
+	select {
+	case change := <-changes:
+		t.Errorf("presence: %s %v", change.Session, change.Kind)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBusLeaveForgetsSession(t *testing.T) {
+	changes := make(presenceRecorder, 10)
+	b := NewBus(context.Background(), changes)
+	defer b.close()
+
+	ctx := context.Background()
+	err := b.Deliver(ctx, &Delivery{Session: "s1", Content: String("hello"), ID: "1", Wait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes.expect(t, "s1", PresenceJoin)
+	err = b.EventTo([]string{"s1"}, String("private"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Leave("s1")
+	changes.expect(t, "s1", PresenceLeave)
+	// handlers are notified of s2 after s1 is forgotten.
+	b.Message("s2", String("hello"))
+	changes.expect(t, "s2", PresenceJoin)
+
+	b.eventsrdy.L.Lock()
+	_, ok := b.private["s1"]
+	b.eventsrdy.L.Unlock()
+	if ok {
+		t.Errorf("private event log retained")
+	}
+	b.dedup.mut.Lock()
+	_, ok = b.dedup.sessions["s1"]
+	b.dedup.mut.Unlock()
+	if ok {
+		t.Errorf("message identifiers retained")
+	}
+}
@@ -0,0 +1,314 @@
+package room
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrQueueFull is returned by Send when the outbound queue is full and its
+// policy is QueueRejectNew.
+var ErrQueueFull = errors.New("outbound queue full")
+
+// QueuePolicy determines which message is discarded when a message is sent
+// while the outbound queue is full.
+type QueuePolicy int
+
+// Policies available for a full outbound queue.
+const (
+	// QueueDropOldest discards the oldest queued message to make room for
+	// the new one.
+	QueueDropOldest QueuePolicy = iota
+
+	// QueueRejectNew keeps the queued messages and Send returns
+	// ErrQueueFull.
+	QueueRejectNew
+)
+
+// QueueConfig configures the outbound queue of a Client.  The zero value is
+// the default configuration.
+type QueueConfig struct {
+	// Size is the maximum number of queued messages.  If zero a queue of 64
+	// messages is used.
+	Size int
+
+	// Policy determines what happens when a message is sent while the queue
+	// is full.
+	Policy QueuePolicy
+
+	// MinBackoff is the delay before the first retry of a message.  Each
+	// further retry doubles the delay up to MaxBackoff.  If zero they
+	// default to 100 milliseconds and 10 seconds respectively.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// OnDrop, if not nil, is called with each message discarded from the
+	// queue and the reason.  Messages rejected by the server are discarded
+	// with the error returned by the server.  Messages discarded to make room
+	// for new ones are discarded with ErrQueueFull.
+	OnDrop func(content Content, err error)
+}
+
+// outQueue holds messages until they are delivered to the server.  Messages
+// are delivered one at a time so they are received in the order they were
+// sent.
+type outQueue struct {
+	config  QueueConfig
+	mut     sync.Mutex
+	msgs    []*jsonMsg
+	ready   chan struct{}   // signaled when a message is pushed
+	drained []chan struct{} // closed when the queue is empty
+	cancel  func()          // stops the delivery goroutine, if running
+	stopped chan struct{}   // closed when the delivery goroutine returns
+}
+
+func newOutQueue(config *QueueConfig) *outQueue {
+	q := &outQueue{ready: make(chan struct{}, 1)}
+	q.configure(config)
+	return q
+}
+
+// configure replaces the configuration of q, filling in defaults.  The
+// delivery goroutine must not be running.
+func (q *outQueue) configure(config *QueueConfig) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	q.config = QueueConfig{}
+	if config != nil {
+		q.config = *config
+	}
+	if q.config.Size <= 0 {
+		q.config.Size = 64
+	}
+	if q.config.MinBackoff <= 0 {
+		q.config.MinBackoff = 100 * time.Millisecond
+	}
+	if q.config.MaxBackoff <= 0 {
+		q.config.MaxBackoff = 10 * time.Second
+	}
+	if q.config.MaxBackoff < q.config.MinBackoff {
+		q.config.MaxBackoff = q.config.MinBackoff
+	}
+}
+
+// start starts the goroutine delivering messages using c until ctx is done.
+func (q *outQueue) start(ctx context.Context, c *Client) {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	q.mut.Lock()
+	q.cancel, q.stopped = cancel, stopped
+	q.mut.Unlock()
+	go func() {
+		defer close(stopped)
+		q.run(ctx, c)
+	}()
+}
+
+// stop stops the delivery goroutine, if it is running, and waits for it to
+// return.  A message being delivered remains at the head of the queue.
+func (q *outQueue) stop() {
+	q.mut.Lock()
+	cancel, stopped := q.cancel, q.stopped
+	q.cancel, q.stopped = nil, nil
+	q.mut.Unlock()
+	if cancel != nil {
+		cancel()
+		<-stopped
+	}
+}
+
+func (q *outQueue) push(m *jsonMsg) error {
+	q.mut.Lock()
+	var dropped *jsonMsg
+	if len(q.msgs) >= q.config.Size {
+		if q.config.Policy == QueueRejectNew {
+			q.mut.Unlock()
+			return ErrQueueFull
+		}
+		// The head may be in flight, in which case it is delivered
+		// anyway and the server discards it if it is sent again.
+		dropped = q.msgs[0]
+		q.msgs = q.msgs[1:]
+	}
+	q.msgs = append(q.msgs, m)
+	q.mut.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	if dropped != nil {
+		q.dropped(dropped, ErrQueueFull)
+	}
+	return nil
+}
+
+// head waits for a message to be queued and returns the oldest one.
+func (q *outQueue) head(ctx context.Context) (*jsonMsg, error) {
+	for {
+		q.mut.Lock()
+		if len(q.msgs) > 0 {
+			m := q.msgs[0]
+			q.mut.Unlock()
+			return m, nil
+		}
+		q.mut.Unlock()
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// remove removes m from the head of the queue if it is still there.
+func (q *outQueue) remove(m *jsonMsg) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if len(q.msgs) > 0 && q.msgs[0] == m {
+		q.msgs = q.msgs[1:]
+	}
+	q.notifyLocked()
+}
+
+// notifyLocked closes the drained channels if the queue is empty.
+func (q *outQueue) notifyLocked() {
+	if len(q.msgs) > 0 {
+		return
+	}
+	for _, c := range q.drained {
+		close(c)
+	}
+	q.drained = nil
+}
+
+func (q *outQueue) depth() int {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return len(q.msgs)
+}
+
+// drop removes all queued messages and returns them.
+func (q *outQueue) drop() []*jsonMsg {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	msgs := q.msgs
+	q.msgs = nil
+	q.notifyLocked()
+	return msgs
+}
+
+// flush waits until the queue is empty.
+func (q *outQueue) flush(ctx context.Context) error {
+	q.mut.Lock()
+	if len(q.msgs) == 0 {
+		q.mut.Unlock()
+		return nil
+	}
+	c := make(chan struct{})
+	q.drained = append(q.drained, c)
+	q.mut.Unlock()
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dropped passes the content of m, as it was given to Send, to OnDrop.
+func (q *outQueue) dropped(m *jsonMsg, err error) {
+	if q.config.OnDrop == nil {
+		return
+	}
+	c, derr := decodeContent(m.D, m.E, m.Y)
+	if derr != nil {
+		c = String(m.D)
+	}
+	q.config.OnDrop(c, err)
+}
+
+// run delivers queued messages using c until ctx is done.  Messages which
+// may not have been received by the server are retried with exponential
+// backoff.  Because each message keeps its identifier the server discards
+// any duplicates.
+func (q *outQueue) run(ctx context.Context, c *Client) {
+	backoff := q.config.MinBackoff
+	for {
+		m, err := q.head(ctx)
+		if err != nil {
+			return
+		}
+		err = c.deliver(ctx, m, 0)
+		if ctx.Err() != nil {
+			// the message remains queued.
+			return
+		}
+		if _, ok := err.(retryableError); ok {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff *= 2
+			if backoff > q.config.MaxBackoff {
+				backoff = q.config.MaxBackoff
+			}
+			continue
+		}
+		backoff = q.config.MinBackoff
+		q.remove(m)
+		if err != nil {
+			q.dropped(m, err)
+		}
+	}
+}
+
+// StartQueue enables an outbound queue for c.  Messages passed to Send are
+// queued and delivered in order by a background goroutine, which retries
+// messages when the server cannot be reached.  The goroutine stops when ctx
+// is done, after which queued messages remain until the queue is started
+// again.  A nil config uses the default configuration.  If the queue is
+// already running its goroutine is stopped first and the queued messages are
+// delivered under the new ctx and config.  StartQueue must not be called
+// while messages are being sent.
+func (c *Client) StartQueue(ctx context.Context, config *QueueConfig) {
+	q := c.queue
+	if q == nil {
+		q = newOutQueue(config)
+		c.queue = q
+	} else {
+		q.stop()
+		q.configure(config)
+	}
+	q.start(ctx, c)
+}
+
+// QueueDepth returns the number of messages waiting in the outbound queue,
+// including a message being delivered.
+func (c *Client) QueueDepth() int {
+	if c.queue == nil {
+		return 0
+	}
+	return c.queue.depth()
+}
+
+// Flush waits until all queued messages have been delivered or discarded.
+func (c *Client) Flush(ctx context.Context) error {
+	if c.queue == nil {
+		return nil
+	}
+	return c.queue.flush(ctx)
+}
+
+// DropQueue discards all queued messages without delivering them and returns
+// the number discarded.  A message being delivered may still be received by
+// the server.  OnDrop is not called for the discarded messages.
+func (c *Client) DropQueue() int {
+	if c.queue == nil {
+		return 0
+	}
+	return len(c.queue.drop())
+}
@@ -0,0 +1,188 @@
+package room
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// flakyHandler fails message requests while down is true.
+type flakyHandler struct {
+	http.Handler
+	mut  sync.Mutex
+	down bool
+}
+
+func (h *flakyHandler) setDown(down bool) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.down = down
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mut.Lock()
+	down := h.down
+	h.mut.Unlock()
+	if down && strings.HasPrefix(r.URL.Path, "/rex/v0/messages") {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestClientQueue(t *testing.T) {
+	var mut sync.Mutex
+	var received []string
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		mut.Lock()
+		defer mut.Unlock()
+		received = append(received, msg.Text())
+	}))
+	defer b.close()
+
+	h := &flakyHandler{Handler: newBusHandler(b)}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	c.Acknowledge = true
+	err := c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.StartQueue(ctx, &QueueConfig{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+	h.setDown(true)
+	texts := []string{"a", "b", "c", "d"}
+	for _, text := range texts {
+		err := c.Send(ctx, String(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if c.QueueDepth() != len(texts) {
+		t.Errorf("depth: %d", c.QueueDepth())
+	}
+
+	h.setDown(false)
+	flushctx, cancelFlush := context.WithTimeout(ctx, time.Second)
+	defer cancelFlush()
+	err = c.Flush(flushctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.QueueDepth() != 0 {
+		t.Errorf("depth: %d", c.QueueDepth())
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if strings.Join(received, "") != strings.Join(texts, "") {
+		t.Errorf("received: %q", received)
+	}
+}
+
+func TestClientQueuePolicy(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	h := &flakyHandler{Handler: newBusHandler(b), down: true}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var dropped []string
+	var droppedType string
+	c := testClient(t, s, nil)
+	c.Session = "session-01"
+	c.StartQueue(ctx, &QueueConfig{
+		Size:       2,
+		MinBackoff: time.Hour,
+		OnDrop: func(content Content, err error) {
+			if err != ErrQueueFull {
+				t.Errorf("drop error: %v", err)
+			}
+			dropped = append(dropped, content.Text())
+			droppedType = ContentType(content)
+		},
+	})
+	for _, content := range []Content{
+		Typed(Bytes([]byte{0xff, 'a'}), "application/octet-stream"),
+		String("b"),
+		String("c"),
+	} {
+		err := c.Send(ctx, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.QueueDepth() != 2 {
+		t.Errorf("depth: %d", c.QueueDepth())
+	}
+	if len(dropped) != 1 || dropped[0] != "\xffa" {
+		t.Errorf("dropped: %q", dropped)
+	}
+	if droppedType != "application/octet-stream" {
+		t.Errorf("dropped type: %q", droppedType)
+	}
+	if n := c.DropQueue(); n != 2 {
+		t.Errorf("dropped: %d", n)
+	}
+
+	c = testClient(t, s, nil)
+	c.Session = "session-01"
+	c.StartQueue(ctx, &QueueConfig{Size: 1, Policy: QueueRejectNew, MinBackoff: time.Hour})
+	err := c.Send(ctx, String("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Send(ctx, String("b"))
+	if err != ErrQueueFull {
+		t.Errorf("error: %v", err)
+	}
+}
+
+func TestClientQueueRestart(t *testing.T) {
+	received := make(chan string, 10)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		received <- msg.Text()
+	}))
+	defer b.close()
+	h := &flakyHandler{Handler: newBusHandler(b), down: true}
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := testClient(t, s, nil)
+	c.Session = "session-01"
+	c.StartQueue(ctx, &QueueConfig{MinBackoff: time.Hour})
+	err := c.Send(ctx, String("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// restarting the queue replaces the goroutine waiting to retry.
+	c.StartQueue(ctx, &QueueConfig{MinBackoff: time.Millisecond})
+	h.setDown(false)
+	flushctx, cancelFlush := context.WithTimeout(ctx, time.Second)
+	defer cancelFlush()
+	err = c.Flush(flushctx)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if text := <-received; text != "a" {
+		t.Errorf("received: %q", text)
+	}
+}
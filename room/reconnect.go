@@ -0,0 +1,191 @@
+package room
+
+import (
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ConnState is the state of a Client's connection to the server while it is
+// run with RunSupervised.
+type ConnState int
+
+// Connection states reported by RunSupervised.
+const (
+	// ConnConnecting is reported while the client makes its first
+	// connection to the server.
+	ConnConnecting ConnState = iota
+
+	// ConnLive is reported when the client is connected and receiving
+	// events.
+	ConnLive
+
+	// ConnDegraded is reported when a live connection fails and the client
+	// is attempting to reconnect.
+	ConnDegraded
+
+	// ConnLost is reported when the client stops trying to connect.
+	// RunSupervised returns after reporting ConnLost.
+	ConnLost
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnConnecting:
+		return "connecting"
+	case ConnLive:
+		return "live"
+	case ConnDegraded:
+		return "degraded"
+	case ConnLost:
+		return "lost"
+	default:
+		return "unknown"
+	}
+}
+
+// ReconnectConfig configures how RunSupervised reconnects to the server.  The
+// zero value is the default configuration.
+type ReconnectConfig struct {
+	// MinBackoff is the delay before the first reconnection attempt.  Each
+	// consecutive failure doubles the delay up to MaxBackoff.  A random
+	// jitter of up to half the delay is subtracted so that clients which
+	// lost their connections together do not reconnect together.  If zero
+	// they default to 250 milliseconds and 15 seconds respectively.  A
+	// connection which fails before it has been live for longer than the
+	// current delay counts as a consecutive failure, so a server which
+	// repeatedly accepts and drops the client is not retried in a tight
+	// loop.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts is the number of consecutive failed connection attempts
+	// after which the connection is considered lost.  If zero the client
+	// never stops trying.
+	MaxAttempts int
+
+	// OnState, if not nil, is called with each change in the connection
+	// state along with the error which caused it, if any.
+	OnState func(state ConnState, err error)
+}
+
+func (config *ReconnectConfig) withDefaults() ReconnectConfig {
+	var _config ReconnectConfig
+	if config != nil {
+		_config = *config
+	}
+	if _config.MinBackoff <= 0 {
+		_config.MinBackoff = 250 * time.Millisecond
+	}
+	if _config.MaxBackoff <= 0 {
+		_config.MaxBackoff = 15 * time.Second
+	}
+	if _config.MaxBackoff < _config.MinBackoff {
+		_config.MaxBackoff = _config.MinBackoff
+	}
+	return _config
+}
+
+// RunSupervised is like Run but reconnects to the server when the connection
+// fails, resuming with the event following the last one processed.  If the
+// events needed to resume have been compacted and c.Handler implements
+// SnapshotHandler the client catches up using the server state.  Changes in
+// the state of the connection are reported to config.OnState.
+//
+// RunSupervised returns nil when ctx is cancelled.  It returns an error after
+// the connection is lost, when the session is removed from the room, when the
+// room closes or when the client cannot resume.
+func (c *Client) RunSupervised(ctx context.Context, start int, config *ReconnectConfig) (next int, err error) {
+	_config := config.withDefaults()
+	s := &supervisor{
+		config: &_config,
+		state:  -1,
+	}
+	nexts := map[string]int{"": start}
+	err = s.run(ctx, c, nexts)
+	return nexts[""], err
+}
+
+// supervisor tracks the connection state of a supervised client.
+type supervisor struct {
+	config *ReconnectConfig
+	state  ConnState
+}
+
+func (s *supervisor) setState(state ConnState, err error) {
+	if state == s.state {
+		return
+	}
+	s.state = state
+	if s.config.OnState != nil {
+		s.config.OnState(state, err)
+	}
+}
+
+func (s *supervisor) run(ctx context.Context, c *Client, next map[string]int) error {
+	s.setState(ConnConnecting, nil)
+	backoff := s.config.MinBackoff
+	failures := 0
+	for {
+		var err error
+		var liveAt time.Time
+		if next[""] < 0 {
+			next[""], err = c.catchUp(ctx)
+		}
+		if err == nil {
+			err = c.run(ctx, next, func() {
+				liveAt = time.Now()
+				s.setState(ConnLive, nil)
+			})
+		}
+		if !liveAt.IsZero() && time.Since(liveAt) > backoff {
+			failures = 0
+			backoff = s.config.MinBackoff
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+
+		switch err := err.(type) {
+		case *CompactedError:
+			topics := len(next)
+			if _, ok := next[PrivateTopic]; ok {
+				topics--
+			}
+			if _, ok := c.Handler.(SnapshotHandler); ok && err.Topic == "" && topics == 1 {
+				next[""] = -1
+				continue
+			}
+			s.setState(ConnLost, err)
+			return err
+		}
+		switch err {
+		case ErrSessionKicked, ErrSessionBanned, ErrClosed:
+			s.setState(ConnLost, err)
+			return err
+		}
+
+		failures++
+		if s.config.MaxAttempts > 0 && failures >= s.config.MaxAttempts {
+			s.setState(ConnLost, err)
+			return err
+		}
+		if s.state == ConnLive {
+			s.setState(ConnDegraded, err)
+		}
+		delay := backoff - time.Duration(rand.Int63n(int64(backoff)/2+1))
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+		backoff *= 2
+		if backoff > s.config.MaxBackoff {
+			backoff = s.config.MaxBackoff
+		}
+	}
+}
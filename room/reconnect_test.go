@@ -0,0 +1,145 @@
+package room
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// stateRecorder records connection states reported to it.
+type stateRecorder struct {
+	mut    sync.Mutex
+	states []ConnState
+}
+
+func (r *stateRecorder) record(state ConnState, err error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.states = append(r.states, state)
+}
+
+func (r *stateRecorder) get() []ConnState {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]ConnState(nil), r.states...)
+}
+
+func TestClientRunSupervised(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	events := make(chan Event, 10)
+	c := testClient(t, s, ehfunc(func(ctx context.Context, c *Client, ev Event) {
+		events <- ev
+	}))
+	states := &stateRecorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.RunSupervised(ctx, 0, &ReconnectConfig{
+			MinBackoff: time.Millisecond,
+			OnState:    states.record,
+		})
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+	}()
+
+	expect := func(i uint64) {
+		select {
+		case ev := <-events:
+			if ev.Index() != i {
+				t.Errorf("index: %d (!= %d)", ev.Index(), i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+	b.Event(String("a"))
+	expect(0)
+
+	s.CloseClientConnections()
+	b.Event(String("b"))
+	expect(1)
+	b.Event(String("c"))
+	expect(2)
+
+	cancel()
+	<-done
+	want := []ConnState{ConnConnecting, ConnLive, ConnDegraded, ConnLive}
+	got := states.get()
+	if len(got) != len(want) {
+		t.Fatalf("states: %v (!= %v)", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("states: %v (!= %v)", got, want)
+			break
+		}
+	}
+}
+
+func TestClientRunSupervisedLost(t *testing.T) {
+	s := httptest.NewServer(nil)
+	c := testClient(t, s, nil)
+	s.Close()
+
+	states := &stateRecorder{}
+	_, err := c.RunSupervised(context.Background(), 0, &ReconnectConfig{
+		MinBackoff:  time.Millisecond,
+		MaxAttempts: 3,
+		OnState:     states.record,
+	})
+	if err == nil {
+		t.Errorf("connected to a closed server")
+	}
+	got := states.get()
+	if len(got) != 2 || got[0] != ConnConnecting || got[1] != ConnLost {
+		t.Errorf("states: %v", got)
+	}
+}
+
+func TestClientRunStreamEnded(t *testing.T) {
+	var mut sync.Mutex
+	var requests []time.Time
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		requests = append(requests, time.Now())
+		mut.Unlock()
+	}))
+	defer s.Close()
+	c := testClient(t, s, nil)
+
+	_, err := c.Run(context.Background(), 0)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("run: %v", err)
+	}
+
+	// the supervisor backs off even though each connection goes live.
+	mut.Lock()
+	requests = nil
+	mut.Unlock()
+	_, err = c.RunSupervised(context.Background(), 0, &ReconnectConfig{
+		MinBackoff:  20 * time.Millisecond,
+		MaxAttempts: 3,
+	})
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("run: %v", err)
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if len(requests) != 3 {
+		t.Fatalf("requests: %d", len(requests))
+	}
+	if d := requests[2].Sub(requests[1]); d < 20*time.Millisecond {
+		t.Errorf("reconnected after %v", d)
+	}
+}
@@ -0,0 +1,100 @@
+package room
+
+import "golang.org/x/net/context"
+
+// Registration is a Handler added to a Bus.  It may be used to remove the
+// handler from the Bus.
+type Registration struct {
+	b *Bus
+	h Handler
+}
+
+// Handler returns the registered Handler.
+func (r *Registration) Handler() Handler {
+	return r.h
+}
+
+// Remove removes the handler from the Bus.  Messages handled after Remove
+// returns are not passed to the handler, although it may still be handling a
+// message received earlier.  Remove may be called from a handler and has no
+// effect if the handler was already removed.
+func (r *Registration) Remove() {
+	b := r.b
+	b.regmut.Lock()
+	defer b.regmut.Unlock()
+	var handlers []*Registration
+	for _, other := range b.handlers {
+		if other != r {
+			handlers = append(handlers, other)
+		}
+	}
+	b.handlers = handlers
+	b.chainLocked()
+}
+
+// AddHandler adds h to the bus message handlers.  Messages are passed to
+// handlers in the order they were added.  The returned Registration may be
+// used to remove h.
+func (b *Bus) AddHandler(h Handler) *Registration {
+	b.regmut.Lock()
+	defer b.regmut.Unlock()
+	r := &Registration{b, h}
+	handlers := make([]*Registration, len(b.handlers), len(b.handlers)+1)
+	copy(handlers, b.handlers)
+	b.handlers = append(handlers, r)
+	b.chainLocked()
+	return r
+}
+
+// ReplaceHandlers atomically replaces all of the bus message handlers with
+// handlers, for example when an application moves to a new phase.  Each
+// message is passed either to the old handlers or to the new ones, never a
+// mix of the two.  Messages already being handled when ReplaceHandlers
+// returns finish with the old handlers.  Like Remove, ReplaceHandlers may be
+// called from a handler.
+func (b *Bus) ReplaceHandlers(handlers ...Handler) []*Registration {
+	b.regmut.Lock()
+	defer b.regmut.Unlock()
+	regs := b.registerLocked(handlers)
+	b.handlers = regs
+	b.chainLocked()
+	return append([]*Registration(nil), regs...)
+}
+
+// registerLocked returns new registrations for handlers.  The caller must
+// hold b.regmut.
+func (b *Bus) registerLocked(handlers []Handler) []*Registration {
+	regs := make([]*Registration, len(handlers))
+	for i, h := range handlers {
+		regs[i] = &Registration{b, h}
+	}
+	return regs
+}
+
+// current returns the handler chain and the registered handlers for the
+// next message, and whether handlers recover from panics.  The returned values
+// are never modified.
+func (b *Bus) current() (Handler, []*Registration, bool) {
+	b.regmut.Lock()
+	defer b.regmut.Unlock()
+	return b.handler, b.handlers, b.recovers
+}
+
+// presenceHandlers passes a presence change to each registered handler
+// implementing PresenceHandler.
+func presenceHandlers(ctx context.Context, handlers []*Registration, change PresenceChange) {
+	for _, r := range handlers {
+		if h, ok := r.h.(PresenceHandler); ok {
+			handlePresence(ctx, h, change)
+		}
+	}
+}
+
+// handlePresence passes change to h, recovering from a panic in h if the
+// Recover middleware is in use.
+func handlePresence(ctx context.Context, h PresenceHandler, change PresenceChange) {
+	if recovering(ctx) {
+		defer recoverPresence(change)
+	}
+	h.HandlePresence(ctx, change)
+}
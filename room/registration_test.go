@@ -0,0 +1,69 @@
+package room
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// phaseRecorder records the messages received by each phase of a game.
+type phaseRecorder map[string][]string
+
+func (r phaseRecorder) handler(phase string) Handler {
+	return hfunc(func(ctx context.Context, msg Msg) {
+		r[phase] = append(r[phase], msg.Text())
+	})
+}
+
+func deliverWait(t *testing.T, b *Bus, text string) {
+	err := b.Deliver(context.Background(), &Delivery{Session: "s", Content: String(text), Wait: true})
+	if err != nil {
+		t.Fatalf("deliver %q: %v", text, err)
+	}
+}
+
+func TestRegistrationRemove(t *testing.T) {
+	rec := make(phaseRecorder)
+	b := NewBus(context.Background())
+	defer b.close()
+	a := b.AddHandler(rec.handler("a"))
+	b.AddHandler(rec.handler("b"))
+
+	deliverWait(t, b, "1")
+	a.Remove()
+	a.Remove()
+	deliverWait(t, b, "2")
+
+	if len(rec["a"]) != 1 {
+		t.Errorf("removed handler: %v", rec["a"])
+	}
+	if len(rec["b"]) != 2 {
+		t.Errorf("remaining handler: %v", rec["b"])
+	}
+}
+
+func TestReplaceHandlers(t *testing.T) {
+	rec := make(phaseRecorder)
+	b := NewBus(context.Background())
+	defer b.close()
+	round := rec.handler("round")
+	lobby := rec.handler("lobby")
+	b.AddHandler(hfunc(func(ctx context.Context, msg Msg) {
+		lobby.HandleMessage(ctx, msg)
+		if msg.Text() == "start" {
+			// phases change from within a handler.
+			b.ReplaceHandlers(round)
+		}
+	}))
+
+	deliverWait(t, b, "join")
+	deliverWait(t, b, "start")
+	deliverWait(t, b, "move")
+
+	if len(rec["lobby"]) != 2 {
+		t.Errorf("lobby: %v", rec["lobby"])
+	}
+	if len(rec["round"]) != 1 || rec["round"][0] != "move" {
+		t.Errorf("round: %v", rec["round"])
+	}
+}
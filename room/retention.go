@@ -0,0 +1,84 @@
+package room
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Retention limits the events retained in each topic of a Bus event log.
+// Limits with a zero value are not enforced.  Clients requesting events which
+// are no longer retained receive a *CompactedError and must catch up using a
+// Snapshot.
+type Retention struct {
+	// MaxEvents is the maximum number of events retained in the log.
+	MaxEvents int
+
+	// MaxAge is the maximum amount of time events are retained after they are
+	// broadcast.  Expired events are dropped when new events are broadcast.
+	MaxAge time.Duration
+
+	// Snapshot causes events in the default topic which are reflected in a
+	// snapshot to be dropped as soon as the snapshot is taken.
+	Snapshot bool
+}
+
+// CompactedError is returned when requested events have been dropped from
+// the event log.
+type CompactedError struct {
+	// Topic is the name of the topic with compacted events.
+	Topic string
+
+	// First is the earliest event index available in the topic.
+	First uint64
+}
+
+func (err *CompactedError) Error() string {
+	if err.Topic != "" {
+		return fmt.Sprintf("events compacted: first available index in topic %q is %d", err.Topic, err.First)
+	}
+	return fmt.Sprintf("events compacted: first available index is %d", err.First)
+}
+
+// Compact drops all events with index less than next from the log of the
+// default topic.
+func (b *Bus) Compact(next uint64) {
+	b.eventsrdy.L.Lock()
+	defer b.eventsrdy.L.Unlock()
+	b.compactLocked(b.logs[""], next)
+}
+
+// retainLocked enforces b.retention on elog.  The caller must hold
+// b.eventsrdy.L.
+func (b *Bus) retainLocked(elog *eventLog) {
+	first := elog.events.First()
+	next := first
+	n := elog.events.Next() - first
+	if b.retention.MaxEvents > 0 && n > uint64(b.retention.MaxEvents) {
+		next = first + n - uint64(b.retention.MaxEvents)
+	}
+	if b.retention.MaxAge > 0 {
+		cutoff := time.Now().Add(-b.retention.MaxAge)
+		for i := next - first; i < uint64(len(elog.at)) && elog.at[i].Before(cutoff); i++ {
+			next = first + i + 1
+		}
+	}
+	b.compactLocked(elog, next)
+}
+
+// compactLocked drops events with index less than next from elog.  The caller
+// must hold b.eventsrdy.L.  Subscriptions waiting on events are woken so they
+// may detect that the events they need are gone.
+func (b *Bus) compactLocked(elog *eventLog, next uint64) {
+	first := elog.events.First()
+	err := elog.events.Truncate(next)
+	if err != nil {
+		log.Printf("[ERR] Failed to compact event log: %v", err)
+	}
+	n := elog.events.First() - first
+	if n == 0 {
+		return
+	}
+	elog.at = elog.at[n:]
+	b.eventsrdy.Broadcast()
+}
@@ -0,0 +1,108 @@
+package room
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusRetentionMaxEvents(t *testing.T) {
+	b := NewBusConfig(context.Background(), &BusConfig{
+		Retention: &Retention{MaxEvents: 3},
+	})
+	defer b.close()
+
+	for i := 0; i < 10; i++ {
+		b.Event(String("test content"))
+	}
+
+	s := b.Subscribe(0)
+	defer b.Unsubscribe(s)
+	if s.Next(nil) {
+		t.Errorf("received compacted event %d", s.Event().Index())
+	}
+	err, ok := s.Err().(*CompactedError)
+	if !ok {
+		t.Fatalf("err: %v", s.Err())
+	}
+	if err.First != 7 {
+		t.Errorf("first: %d", err.First)
+	}
+
+	s = b.Subscribe(7)
+	defer b.Unsubscribe(s)
+	for i := uint64(7); i < 10; i++ {
+		if !s.Next(time.After(time.Second)) {
+			t.Fatalf("no event %d: %v", i, s.Err())
+		}
+		if s.Event().Index() != i {
+			t.Errorf("index: %d (!= %d)", s.Event().Index(), i)
+		}
+	}
+}
+
+func TestBusRetentionMaxAge(t *testing.T) {
+	b := NewBusConfig(context.Background(), &BusConfig{
+		Retention: &Retention{MaxAge: 20 * time.Millisecond},
+	})
+	defer b.close()
+
+	b.Event(String("test content"))
+	b.Event(String("test content"))
+	time.Sleep(30 * time.Millisecond)
+	b.Event(String("test content"))
+
+	s := b.Subscribe(0)
+	defer b.Unsubscribe(s)
+	err, ok := s.Err().(*CompactedError)
+	if !ok {
+		t.Fatalf("err: %v", s.Err())
+	}
+	if err.First != 2 {
+		t.Errorf("first: %d", err.First)
+	}
+}
+
+func TestBusRetentionSnapshot(t *testing.T) {
+	b := NewBusConfig(context.Background(), &BusConfig{
+		Retention: &Retention{Snapshot: true},
+	})
+	defer b.close()
+	b.SetSnapshotter(snapshotFunc(func(ctx context.Context) (Content, error) {
+		return String("test state"), nil
+	}))
+
+	b.Event(String("test content"))
+	b.Event(String("test content"))
+	b.Event(String("test content"))
+
+	// a subscription waiting for events must be terminated when the events it
+	// requires are compacted.
+	s := b.Subscribe(0)
+	defer b.Unsubscribe(s)
+	if !s.Next(time.After(time.Second)) {
+		t.Fatalf("no event: %v", s.Err())
+	}
+
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if snap.Next != 3 {
+		t.Errorf("next: %d", snap.Next)
+	}
+
+	// an event retrieved before the snapshot may still be received.
+	for s.Next(time.After(time.Second)) {
+	}
+	if err, ok := s.Err().(*CompactedError); !ok || err.First != 3 {
+		t.Errorf("waiting subscription: %v", s.Err())
+	}
+
+	s = b.Subscribe(1)
+	defer b.Unsubscribe(s)
+	if _, ok := s.Err().(*CompactedError); !ok {
+		t.Errorf("err: %v", s.Err())
+	}
+}
@@ -0,0 +1,102 @@
+package room
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// UnknownRouteError is the error of a call which a Router could not route.
+type UnknownRouteError struct {
+	Route string
+}
+
+func (err *UnknownRouteError) Error() string {
+	if err.Route == "" {
+		return "message has no route"
+	}
+	return fmt.Sprintf("unknown route %q", err.Route)
+}
+
+// RouteByType returns the type tag of the content of msg, which is the route
+// of values encoded by a TypeRegistry.  Untyped messages have the empty
+// route.
+func RouteByType(msg Msg) string {
+	_, params, err := mime.ParseMediaType(ContentType(msg))
+	if err != nil {
+		return ""
+	}
+	return params["tag"]
+}
+
+// Router is a Handler which dispatches each message to the Handler registered
+// for its route.  Messages with a route that has no Handler are passed to the
+// fallback Handler.  Without a fallback they are logged and rejected, so calls
+// fail with an *UnknownRouteError and senders waiting for a message receive a
+// *RejectedError.  A Router is safe for concurrent use, and routes may be added
+// while messages are being handled.
+type Router struct {
+	route    func(Msg) string
+	mut      sync.RWMutex
+	routes   map[string]Handler
+	fallback Handler
+}
+
+var _ Handler = &Router{}
+
+// NewRouter returns a new Router which computes the route of messages with
+// route.  If route is nil RouteByType is used.
+func NewRouter(route func(Msg) string) *Router {
+	if route == nil {
+		route = RouteByType
+	}
+	return &Router{
+		route:  route,
+		routes: make(map[string]Handler),
+	}
+}
+
+// Handle registers h to handle messages with the given route, replacing any
+// Handler previously registered for the route.
+func (r *Router) Handle(route string, h Handler) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.routes[route] = h
+}
+
+// HandleFunc registers fn to handle messages with the given route.
+func (r *Router) HandleFunc(route string, fn func(ctx context.Context, msg Msg)) {
+	r.Handle(route, handlerFunc(fn))
+}
+
+// Fallback sets the Handler of messages whose route has no Handler.
+func (r *Router) Fallback(h Handler) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.fallback = h
+}
+
+// HandleMessage implements Handler.
+func (r *Router) HandleMessage(ctx context.Context, msg Msg) {
+	route := r.route(msg)
+	r.mut.RLock()
+	h, ok := r.routes[route]
+	if !ok {
+		h = r.fallback
+	}
+	r.mut.RUnlock()
+	if h == nil {
+		err := &UnknownRouteError{route}
+		log.Printf("[INFO] Dropped message from session %q: %v", msg.Session(), err)
+		if c := contextCall(ctx); c != nil {
+			c.reply(nil, err)
+		} else {
+			rejectMessage(ctx, err)
+		}
+		return
+	}
+	h.HandleMessage(ctx, msg)
+}
@@ -0,0 +1,124 @@
+package room
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestRouteByType(t *testing.T) {
+	for i, test := range []struct {
+		c     Content
+		route string
+	}{
+		{Typed(String("{}"), "application/json; tag=move"), "move"},
+		{Typed(String("{}"), "application/json"), ""},
+		{Typed(String("{}"), "invalid;;"), ""},
+		{String("hello"), ""},
+	} {
+		route := RouteByType(newMsg("s", test.c, new(Clock).Now))
+		if route != test.route {
+			t.Errorf("test %d: route %q (!= %q)", i, route, test.route)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	routed := make(chan string, 1)
+	router := NewRouter(func(msg Msg) string { return msg.Text() })
+	router.HandleFunc("move", func(ctx context.Context, msg Msg) {
+		routed <- "move"
+	})
+	router.HandleFunc("chat", func(ctx context.Context, msg Msg) {
+		routed <- "chat"
+	})
+
+	ctx := context.Background()
+	for _, route := range []string{"move", "chat", "move"} {
+		router.HandleMessage(ctx, newMsg("s", String(route), new(Clock).Now))
+		if r := <-routed; r != route {
+			t.Errorf("message %q routed to %q", route, r)
+		}
+	}
+
+	// messages without a route are dropped.
+	router.HandleMessage(ctx, newMsg("s", String("jump"), new(Clock).Now))
+	select {
+	case r := <-routed:
+		t.Errorf("unknown message routed to %q", r)
+	default:
+	}
+
+	router.Fallback(hfunc(func(ctx context.Context, msg Msg) {
+		routed <- "fallback"
+	}))
+	router.HandleMessage(ctx, newMsg("s", String("jump"), new(Clock).Now))
+	if r := <-routed; r != "fallback" {
+		t.Errorf("unknown message routed to %q", r)
+	}
+}
+
+func TestRouterUnknownCall(t *testing.T) {
+	types := NewTypeRegistry(JSON)
+	types.Register("move", testMove{})
+	types.Register("chat", testChat{})
+	router := NewRouter(nil)
+	router.Handle("move", types.Handler(func(ctx context.Context, msg Msg, v interface{}) {
+		Reply(ctx, String("moved"))
+	}))
+	b := NewBus(context.Background(), router)
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	ctx := context.Background()
+	for _, transport := range []Transport{TransportHTTP, TransportWebSocket} {
+		c := testClient(t, s, nil)
+		c.Transport = transport
+		c.Session = "session-01"
+		cctx, cancel := context.WithCancel(ctx)
+		if transport == TransportWebSocket {
+			go c.Run(cctx, int(b.next()))
+		}
+
+		move, _ := types.Encode(testMove{"dave", 1, 1})
+		reply, err := c.Call(ctx, move)
+		if err != nil || reply.Text() != "moved" {
+			t.Errorf("%v: move: %v %v", transport, reply, err)
+		}
+
+		chat, _ := types.Encode(testChat{"hi"})
+		_, err = c.Call(ctx, chat)
+		if err, ok := err.(*UnknownRouteError); !ok || err.Route != "chat" {
+			t.Errorf("%v: chat: %v", transport, err)
+		}
+		cancel()
+	}
+}
+
+func TestRouterUnknownMessage(t *testing.T) {
+	handled := make(chan string, 1)
+	router := NewRouter(func(msg Msg) string { return msg.Text() })
+	router.HandleFunc("move", func(ctx context.Context, msg Msg) {
+		handled <- msg.Text()
+	})
+	b := NewBus(context.Background(), router)
+	defer b.close()
+
+	ctx := context.Background()
+	err := b.Deliver(ctx, &Delivery{Session: "s", Content: String("jump"), ID: "1", Wait: true})
+	if _, ok := err.(*RejectedError); !ok {
+		t.Fatalf("error: %v", err)
+	}
+
+	// the rejected message is forgotten so a corrected message may reuse its
+	// id.
+	err = b.Deliver(ctx, &Delivery{Session: "s", Content: String("move"), ID: "1", Wait: true})
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if r := <-handled; r != "move" {
+		t.Errorf("handled: %q", r)
+	}
+}
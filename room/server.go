@@ -7,7 +7,10 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // Room represents a single shared enivornment managed by a server.  The
@@ -30,17 +33,32 @@ type ServerConfig struct {
 	// Addr is an optional address to bind.  If empty, the address of ":0" will
 	// be used.
 	Addr string
+
+	// Join is an optional policy restricting which clients may join the room.
+	// If nil any client may send messages and receive events.
+	Join *JoinPolicy
+
+	// AllowedOrigins are the origins of web pages, such as
+	// "http://192.168.1.20:8080", which may use the room from a browser in
+	// addition to pages served from the room's own address.  The origin "*"
+	// allows any page.  Native clients are not affected.
+	AllowedOrigins []string
 }
 
 // Server is a server used by a TV application to run a game or collaborative
 // procedure.
 type Server struct {
 	config   *ServerConfig
+	auth     *joinAuth
 	handler  *httpBus
 	tcp      *net.TCPListener
 	http     *http.Server
 	serving  chan struct{}
 	serveErr chan error
+
+	mut    sync.Mutex
+	disco  Discovery
+	closed bool
 }
 
 // NewServer initializes a new server, but does not start serving clients.
@@ -51,16 +69,27 @@ func NewServer(config *ServerConfig) *Server {
 
 	s := &Server{}
 	s.config = config
+	var err error
+	s.auth, err = newJoinAuth(config.Join)
+	if err != nil {
+		panic(err)
+	}
 	s.initHTTP()
 
 	return s
 }
 
+// JoinCode returns the code clients must present to join the room.  If the
+// server has no JoinPolicy JoinCode returns an empty string.
+func (s *Server) JoinCode() string {
+	return s.auth.code
+}
+
 func (s *Server) initHTTP() {
 	if s.handler != nil {
 		panic("already initialized")
 	}
-	s.handler = newHTTPBus(s.bus())
+	s.handler = newHTTPBus(s.bus(), s.auth, newOriginPolicy(s.config.AllowedOrigins))
 	s.serving = make(chan struct{})
 	s.serveErr = make(chan error, 1)
 	s.http = &http.Server{
@@ -86,7 +115,12 @@ func (s *Server) Start() error {
 			return
 		}
 		s.serveErr <- nil
-		s.serveErr <- s.http.Serve(s.tcp)
+		err = s.http.Serve(s.tcp)
+		if s.isClosed() {
+			// the listener was closed by Shutdown.
+			err = nil
+		}
+		s.serveErr <- err
 	}()
 
 	err := <-s.serveErr
@@ -97,8 +131,8 @@ func (s *Server) Start() error {
 	return err
 }
 
-// Wait returns when the server has terminated.  Wait must not be called more
-// than once.
+// Wait returns when the server has terminated.  After Shutdown Wait returns
+// nil.  Wait must not be called more than once.
 func (s *Server) Wait() error {
 	select {
 	case <-s.serving:
@@ -166,26 +200,41 @@ func (s *Server) Event(c Content) {
 }
 
 func newBusHandler(b *Bus) http.Handler {
-	return newHTTPBus(b)
+	return newHTTPBus(b, nil, nil)
 }
 
 // httpBus exposes the bus functions Subscribe and Message over http endpoints.
+// If auth requires tokens clients must join the room to obtain one.
+// Browser pages from origins allowed by origins may use the endpoints.
 type httpBus struct {
-	b   *Bus
-	mux *http.ServeMux // FIXME use something that is faster
+	b        *Bus
+	auth     *joinAuth
+	mux      *http.ServeMux // FIXME use something that is faster
+	requests *drain         // requests being served
+	origins  *originPolicy  // cross-origin pages allowed, if not nil
 }
 
-func newHTTPBus(b *Bus) *httpBus {
+func newHTTPBus(b *Bus, auth *joinAuth, origins *originPolicy) *httpBus {
 	h := &httpBus{
-		b:   b,
-		mux: http.NewServeMux(),
+		b:        b,
+		auth:     auth,
+		origins:  origins,
+		mux:      http.NewServeMux(),
+		requests: newDrain(),
+	}
+	if auth != nil {
+		b.notifyKick(auth.revoke)
 	}
 
 	// register all api routes
-	h.mux.HandleFunc("/rex/v0/events", busEventsHandler(b))
-	h.mux.HandleFunc("/rex/v0/messages", busMessagesHandler(b))
-	// TODO: a way for new clients to catch up without log compaction
-	// h.mux.HandleFunc("/rex/v0/state", busStateHandler(b))
+	h.mux.HandleFunc("/rex/v0/sessions", busSessionsHandler(b, auth))
+	h.mux.HandleFunc("/rex/v0/ping", busPingHandler(b, auth))
+	h.mux.HandleFunc("/rex/v0/join", busJoinHandler(b, auth))
+	h.mux.HandleFunc("/rex/v0/events", busEventsHandler(b, auth))
+	h.mux.HandleFunc("/rex/v0/messages", busMessagesHandler(b, auth))
+	h.mux.HandleFunc("/rex/v0/calls", busCallsHandler(b, auth))
+	h.mux.HandleFunc("/rex/v0/state", busStateHandler(b, auth))
+	h.mux.Handle("/rex/v0/ws", busWebSocketHandler(b, auth, origins))
 
 	return h
 }
@@ -194,40 +243,157 @@ func jsonError(id, reason string) string {
 	return fmt.Sprintf(`{"error":%q, "reason":%q}`, id, reason)
 }
 
+// jsonErrorBody is the decoded form of an error produced by jsonError or
+// jsonCompacted.
+type jsonErrorBody struct {
+	ID     string `json:"error"`
+	Reason string `json:"reason"`
+	Topic  string `json:"topic"`
+	First  uint64 `json:"first"`
+}
+
+func (e *jsonErrorBody) err() error {
+	switch e.ID {
+	case "event_compacted":
+		return &CompactedError{Topic: e.Topic, First: e.First}
+	case "session_kicked":
+		return ErrSessionKicked
+	case "session_banned":
+		return ErrSessionBanned
+	case "room_closed":
+		return ErrClosed
+	case "call_unanswered":
+		return ErrNoReply
+	case "call_timeout":
+		return context.DeadlineExceeded
+	case "message_rejected":
+		return &RejectedError{e.Reason}
+	}
+	return fmt.Errorf("%s: %s", e.ID, e.Reason)
+}
+
+func jsonCompacted(err *CompactedError) string {
+	return fmt.Sprintf(`{"error":"event_compacted", "reason":%q, "topic":%q, "first":%d}`, err.Error(), err.Topic, err.First)
+}
+
 func jsonMethodNotAllowed(allow ...string) string {
 	return jsonError("http_method_invalid", fmt.Sprintf("request method must be one of %v", allow))
 }
 
-func busEventsHandler(b *Bus) http.HandlerFunc {
+// queryStarts returns the start index requested in the query of r for each
+// topic.  If the query names no topic only the default topic is included.  A
+// single start value applies to every topic, otherwise each start value
+// corresponds to the topic at the same position in the query.
+func queryStarts(r *http.Request) (map[string]int, error) {
+	q := r.URL.Query()
+	topics := q["topic"]
+	if len(topics) == 0 {
+		topics = []string{""}
+	}
+	_starts := q["start"]
+	if len(_starts) > 1 && len(_starts) != len(topics) {
+		return nil, fmt.Errorf("mismatched start and topic parameters")
+	}
+	starts := make(map[string]int, len(topics))
+	for i, topic := range topics {
+		var _start string
+		if len(_starts) == 1 {
+			_start = _starts[0]
+		} else if len(_starts) > 1 {
+			_start = _starts[i]
+		}
+		starts[topic] = 0
+		if _start != "" {
+			start, err := strconv.Atoi(_start)
+			if err != nil {
+				return nil, err
+			}
+			starts[topic] = start
+		}
+	}
+	return starts, nil
+}
+
+// queryStream returns true if the query of r requests a long-lived event
+// stream.
+func queryStream(r *http.Request) bool {
+	stream, _ := strconv.ParseBool(r.URL.Query().Get("stream"))
+	return stream
+}
+
+func busEventsHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		if r.Method != "GET" {
 			w.Header().Set("Allow", "GET")
 			w.WriteHeader(http.StatusMethodNotAllowed)
-			fmt.Fprintln(w, jsonMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("GET"))
 			return
 		}
 
-		q := r.URL.Query()
-		_start := q.Get("start")
-		start := 0
-		if _start != "" {
-			var err error
-			start, err = strconv.Atoi(_start)
+		session := r.URL.Query().Get("session")
+		if !auth.authorize(w, r, session) {
+			return
+		}
+		if !admit(b, w, r, session) {
+			return
+		}
+		b.sessions.seenFrom(session, remoteHost(r))
+
+		starts, err := queryStarts(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("parameter_invalid", "invalid start index"))
+			return
+		}
+		if _, ok := starts[PrivateTopic]; ok && !auth.owns(r, session) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, jsonError("session_unauthorized", "a session token is required to receive private events"))
+			return
+		}
+		stream := acceptsEventStream(r)
+		if stream && len(starts) == 1 {
+			last, ok, err := lastEventStart(r)
 			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintln(w, jsonError("parameter_invalid", "invalid start index"))
+				fmt.Fprintln(w, jsonError("parameter_invalid", "invalid Last-Event-ID"))
 				return
 			}
+			if ok {
+				for topic := range starts {
+					starts[topic] = last
+				}
+			}
 		}
 
-		sub := b.Subscribe(start)
+		sub := b.SubscribeTopics(session, starts)
 		defer b.Unsubscribe(sub)
+		if err, ok := sub.Err().(*CompactedError); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			fmt.Fprintln(w, jsonCompacted(err))
+			return
+		}
+
+		if stream {
+			serveEventStream(w, sub)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 
 		enc := json.NewEncoder(w)
+		if queryStream(r) {
+			streamEvents(w, sub, jsonHeartbeat, func(event Event) error {
+				return enc.Encode(newJSONEvent(event))
+			})
+			if frame := jsonTerminated(sub.Err()); frame != "" {
+				fmt.Fprintln(w, frame)
+			}
+			return
+		}
+
 		var timeout <-chan time.Time
 		for sub.Next(timeout) {
 			if timeout == nil {
@@ -241,16 +407,54 @@ func busEventsHandler(b *Bus) http.HandlerFunc {
 				return
 			}
 		}
+		if frame := jsonTerminated(sub.Err()); frame != "" {
+			fmt.Fprintln(w, frame)
+		}
 	}
 }
 
-func busMessagesHandler(b *Bus) http.HandlerFunc {
+func busStateHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("GET"))
+			return
+		}
+		if !auth.authorize(w, r, "") {
+			return
+		}
+
+		snap, err := b.Snapshot()
+		if err == ErrNoSnapshot {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, jsonError("state_unavailable", "the server does not provide state snapshots"))
+			return
+		}
+		if err != nil {
+			log.Printf("[ERR] Failed to snapshot state: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintln(w, jsonError("state_error", "unable to produce a state snapshot"))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		err = json.NewEncoder(w).Encode(newJSONSnapshot(snap))
+		if err != nil {
+			log.Printf("[INFO] Failed to deliver state to client: %v", err)
+		}
+	}
+}
+
+func busMessagesHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 		if r.Method != "POST" {
 			w.Header().Set("Allow", "POST")
 			w.WriteHeader(http.StatusMethodNotAllowed)
-			fmt.Fprintln(w, jsonMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("POST"))
 			return
 		}
 
@@ -282,6 +486,14 @@ func busMessagesHandler(b *Bus) http.HandlerFunc {
 			fmt.Fprintln(w, jsonError("protocol_error", "missing message content"))
 			return
 		}
+		encoding, _ := msg["encoding"].(string)
+		contentType, _ := msg["type"].(string)
+		c, err := decodeContent(content, encoding, contentType)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("protocol_error", err.Error()))
+			return
+		}
 		var session string
 		_session, ok := msg["session"]
 		if ok {
@@ -293,10 +505,82 @@ func busMessagesHandler(b *Bus) http.HandlerFunc {
 			return
 		}
 
-		b.Message(session, String(content))
+		if !auth.authorize(w, r, session) {
+			return
+		}
+		if !admit(b, w, r, session) {
+			return
+		}
+		b.sessions.seenFrom(session, remoteHost(r))
+
+		var t Time
+		if _t, ok := msg["time"]; ok {
+			js, _ := json.Marshal(_t)
+			err := json.Unmarshal(js, &t)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, jsonError("protocol_error", "invalid message time"))
+				return
+			}
+		}
+		topic, _ := msg["topic"].(string)
+		id, _ := msg["id"].(string)
+		wait, _ := strconv.ParseBool(r.URL.Query().Get("wait"))
+
+		// When waiting for handlers the delivery is abandoned if the
+		// client disconnects.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if cn, ok := w.(http.CloseNotifier); ok && wait {
+			closed := cn.CloseNotify()
+			go func() {
+				select {
+				case <-closed:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
+
+		err = b.Deliver(ctx, &Delivery{
+			Topic:   topic,
+			Session: session,
+			Content: c,
+			Time:    t,
+			ID:      id,
+			Wait:    wait,
+		})
+		switch err {
+		case nil:
+		case ErrSessionKicked:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, jsonKicked())
+		case ErrClosed:
+			writeClosed(w)
+		case ErrTimeAhead:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("protocol_error", err.Error()))
+		case context.Canceled:
+		default:
+			if err, ok := err.(*RejectedError); ok {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, jsonError("message_rejected", err.Reason))
+				return
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, jsonError("message_undelivered", err.Error()))
+		}
 	}
 }
 
 func (b *httpBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !b.requests.add() {
+		writeClosed(w)
+		return
+	}
+	defer b.requests.release()
+	if b.origins.serveCORS(w, r) {
+		return
+	}
 	b.mux.ServeHTTP(w, r)
 }
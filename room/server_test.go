@@ -104,3 +104,169 @@ func TestHTTPBusMessages(t *testing.T) {
 		t.Errorf("content: %v", msg[0].Text())
 	}
 }
+
+func TestHTTPBusState(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	h := newBusHandler(b)
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	url := fmt.Sprintf("%s/rex/v0/state", s.URL)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status: %s", resp.Status)
+	}
+
+	b.SetSnapshotter(snapshotFunc(func(ctx context.Context) (Content, error) {
+		return String("test state"), nil
+	}))
+	b.Event(String("test content"))
+	b.Event(String("test content"))
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		t.Fatalf("error %s: %s", resp.Status, b)
+	}
+	snap := newJSONSnapshot(nil)
+	err = json.NewDecoder(resp.Body).Decode(snap)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if snap.Next != 2 {
+		t.Errorf("next: %d", snap.Next)
+	}
+	if snap.Text() != "test state" {
+		t.Errorf("content: %v", snap.Text())
+	}
+}
+
+func TestHTTPBusEventsCompacted(t *testing.T) {
+	b := NewBusConfig(context.Background(), &BusConfig{
+		Retention: &Retention{MaxEvents: 1},
+	})
+	defer b.close()
+	b.Event(String("test content"))
+	b.Event(String("test content"))
+
+	h := newBusHandler(b)
+	s := httptest.NewServer(h)
+	defer s.Close()
+
+	url := fmt.Sprintf("%s/rex/v0/events?start=0", s.URL)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("status: %s", resp.Status)
+	}
+	e := map[string]interface{}{}
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if e["error"] != "event_compacted" || e["first"] != float64(1) {
+		t.Errorf("response: %v", e)
+	}
+}
+
+func TestHTTPBusEventsSession(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	b.EventTo([]string{"session-02"}, String("other content"))
+	b.EventTo([]string{"session-01"}, String("test content"))
+
+	auth, _ := newJoinAuth(nil)
+	token, err := auth.join("127.0.0.1", "session-01", "")
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	_, err = auth.join("127.0.0.1", "session-01", "")
+	if err != errSessionTaken {
+		t.Errorf("second join: %v", err)
+	}
+	other, _ := auth.join("127.0.0.1", "session-02", "")
+	s := httptest.NewServer(newHTTPBus(b, auth, nil))
+	defer s.Close()
+
+	url := fmt.Sprintf("%s/rex/v0/events?session=session-01&topic=%s&start=0", s.URL, PrivateTopic)
+	for _, test := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{other, http.StatusUnauthorized},
+		{token, http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("http: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("token %q: status %d (!= %d)", test.token, resp.StatusCode, test.status)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		e := map[string]interface{}{}
+		err = json.NewDecoder(resp.Body).Decode(&e)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if e["topic"] != PrivateTopic || e["index"] != float64(0) || e["data"] != "test content" {
+			t.Errorf("event: %v", e)
+		}
+	}
+}
+
+func TestClientPrivateEvents(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	auth, _ := newJoinAuth(nil)
+	s := httptest.NewServer(newHTTPBus(b, auth, nil))
+	defer s.Close()
+
+	for _, transport := range []Transport{TransportHTTP, TransportWebSocket} {
+		events := make(chan Event, 10)
+		c := testClient(t, s, ehfunc(func(ctx context.Context, c *Client, event Event) {
+			events <- event
+		}))
+		c.Transport = transport
+		err := c.CreateSession(context.Background(), "player")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go c.Run(ctx, int(b.next()))
+
+		b.EventTo([]string{"someone-else"}, String("other"))
+		b.EventTo([]string{c.Session}, String("mine"))
+		select {
+		case event := <-events:
+			if event.Topic() != PrivateTopic || event.Index() != 0 || event.Text() != "mine" {
+				t.Errorf("%v: event %q %d %q", transport, event.Topic(), event.Index(), event.Text())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v: private event not received", transport)
+		}
+		cancel()
+	}
+}
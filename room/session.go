@@ -0,0 +1,335 @@
+package room
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bmatsuo/uuid"
+	"golang.org/x/net/context"
+)
+
+// SessionInfo describes a session known to a SessionRegistry.
+type SessionInfo struct {
+	// ID is the session identifier used in messages and events.
+	ID string
+
+	// Name is the common name for the session, the identifier other clients
+	// would see as a "user".
+	Name string
+
+	// Joined is the time the session was registered.
+	Joined time.Time
+
+	// LastSeen is the time the session last sent a message or subscribed to
+	// events.
+	LastSeen time.Time
+
+	// Metadata holds application defined values associated with the session.
+	Metadata map[string]string
+
+	// Addr is the network address the session was first seen from, if
+	// known.
+	Addr string
+
+	// Device is an identifier for the client device provided when the
+	// session was created, if any.
+	Device string
+
+	// Clock is the estimate of the server clock most recently reported by
+	// the session's client.  It is zero if the client has not reported one.
+	Clock ClockSample
+}
+
+func (info *SessionInfo) copy() *SessionInfo {
+	_info := &SessionInfo{}
+	*_info = *info
+	if info.Metadata != nil {
+		_info.Metadata = make(map[string]string, len(info.Metadata))
+		for k, v := range info.Metadata {
+			_info.Metadata[k] = v
+		}
+	}
+	return _info
+}
+
+// SessionRegistry tracks the sessions which have joined a Bus.  Sessions are
+// registered by clients through the server or, for clients which generate
+// their own identifiers, when they are first seen by the Bus.  A
+// SessionRegistry is safe for concurrent use.
+type SessionRegistry struct {
+	mut      sync.RWMutex
+	sessions map[string]*SessionInfo
+}
+
+// NewSessionRegistry allocates and returns a new SessionRegistry.
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*SessionInfo),
+	}
+}
+
+// Create registers a new session with the given name and metadata and
+// returns it.  The session identifier is assigned by the registry.
+func (r *SessionRegistry) Create(name string, metadata map[string]string) *SessionInfo {
+	return r.create(&SessionInfo{Name: name, Metadata: metadata})
+}
+
+// create registers a copy of info with a newly assigned identifier.
+func (r *SessionRegistry) create(info *SessionInfo) *SessionInfo {
+	now := time.Now()
+	info = info.copy()
+	info.Joined = now
+	info.LastSeen = now
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for {
+		info.ID = uuid.New()
+		if _, ok := r.sessions[info.ID]; !ok {
+			break
+		}
+	}
+	r.sessions[info.ID] = info
+	return info.copy()
+}
+
+// Lookup returns the session with the given identifier.  The returned value
+// is a copy and modifying it does not affect the registry.
+func (r *SessionRegistry) Lookup(session string) (*SessionInfo, bool) {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	info, ok := r.sessions[session]
+	if !ok {
+		return nil, false
+	}
+	return info.copy(), true
+}
+
+// Sessions returns all registered sessions ordered by the time they joined.
+func (r *SessionRegistry) Sessions() []*SessionInfo {
+	r.mut.RLock()
+	sessions := make([]*SessionInfo, 0, len(r.sessions))
+	for _, info := range r.sessions {
+		sessions = append(sessions, info.copy())
+	}
+	r.mut.RUnlock()
+	sort.Sort(sessionsByJoined(sessions))
+	return sessions
+}
+
+// SetName changes the name of session.  SetName returns false if the session
+// is not registered.
+func (r *SessionRegistry) SetName(session string, name string) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	info, ok := r.sessions[session]
+	if ok {
+		info.Name = name
+	}
+	return ok
+}
+
+// SetMetadata associates value with key in the metadata of session.  An empty
+// value removes key.  SetMetadata returns false if the session is not
+// registered.
+func (r *SessionRegistry) SetMetadata(session string, key, value string) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	info, ok := r.sessions[session]
+	if !ok {
+		return false
+	}
+	if value == "" {
+		delete(info.Metadata, key)
+		return true
+	}
+	if info.Metadata == nil {
+		info.Metadata = make(map[string]string)
+	}
+	info.Metadata[key] = value
+	return true
+}
+
+// Remove removes session from the registry.
+func (r *SessionRegistry) Remove(session string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.sessions, session)
+}
+
+// touch records that session was seen at time t, registering it if
+// necessary.
+func (r *SessionRegistry) touch(session string, t time.Time) {
+	if session == "" {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	info, ok := r.sessions[session]
+	if !ok {
+		info = &SessionInfo{ID: session, Joined: t}
+		r.sessions[session] = info
+	}
+	info.LastSeen = t
+}
+
+// seenFrom records the address session was seen from if none is known,
+// registering the session if necessary.
+func (r *SessionRegistry) seenFrom(session string, addr string) {
+	if session == "" {
+		return
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	info, ok := r.sessions[session]
+	if !ok {
+		now := time.Now()
+		info = &SessionInfo{ID: session, Joined: now, LastSeen: now}
+		r.sessions[session] = info
+	}
+	if info.Addr == "" {
+		info.Addr = addr
+	}
+}
+
+// setClock records the estimate of the server clock reported by the client
+// of session.  The session must already be registered, for instance with
+// seenFrom.
+func (r *SessionRegistry) setClock(session string, sample ClockSample) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	info, ok := r.sessions[session]
+	if ok {
+		info.Clock = sample
+	}
+}
+
+// clockOffset returns the offset of the server clock reported by the client
+// of session, or zero if none was reported.
+func (r *SessionRegistry) clockOffset(session string) time.Duration {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	info, ok := r.sessions[session]
+	if !ok {
+		return 0
+	}
+	return info.Clock.Offset
+}
+
+type sessionsByJoined []*SessionInfo
+
+func (s sessionsByJoined) Len() int      { return len(s) }
+func (s sessionsByJoined) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s sessionsByJoined) Less(i, j int) bool {
+	if s[i].Joined.Equal(s[j].Joined) {
+		return s[i].ID < s[j].ID
+	}
+	return s[i].Joined.Before(s[j].Joined)
+}
+
+// Sessions returns the SessionRegistry of the Bus associated with ctx.  If
+// ctx has no associated Bus, Sessions returns nil.
+func Sessions(ctx context.Context) *SessionRegistry {
+	b := contextBus(ctx)
+	if b == nil {
+		return nil
+	}
+	return b.sessions
+}
+
+// LookupSession returns the session registered with the Bus associated with
+// ctx.
+func LookupSession(ctx context.Context, session string) (*SessionInfo, bool) {
+	r := Sessions(ctx)
+	if r == nil {
+		return nil, false
+	}
+	return r.Lookup(session)
+}
+
+func busSessionsHandler(b *Bus, auth *joinAuth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method == "DELETE" {
+			busLeave(b, auth, w, r)
+			return
+		}
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintln(w, jsonMethodNotAllowed("POST", "DELETE"))
+			return
+		}
+
+		var req struct {
+			Name     string            `json:"name"`
+			Code     string            `json:"code"`
+			Device   string            `json:"device"`
+			Metadata map[string]string `json:"metadata"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, jsonError("http_request_invalid", "could not read a complete entity"))
+			return
+		}
+
+		addr := remoteHost(r)
+		if b.bans.banned(addr, req.Device, time.Now()) {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, jsonBanned())
+			return
+		}
+
+		info := b.sessions.create(&SessionInfo{
+			Name:     req.Name,
+			Metadata: req.Metadata,
+			Addr:     addr,
+			Device:   req.Device,
+		})
+		token, err := auth.join(remoteHost(r), info.ID, req.Code)
+		if err != nil {
+			b.sessions.Remove(info.ID)
+			writeJoinError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&jsonSession{
+			Session: info.ID,
+			Name:    info.Name,
+			Token:   token,
+		})
+	}
+}
+
+// busLeave removes the session named in the query of r from the sessions
+// present on b.
+func busLeave(b *Bus, auth *joinAuth, w http.ResponseWriter, r *http.Request) {
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, jsonError("protocol_error", "missing session"))
+		return
+	}
+	if !auth.authorize(w, r, session) {
+		return
+	}
+	if !admit(b, w, r, session) {
+		return
+	}
+	b.Leave(session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jsonSession is the response to a request creating a session.  Token is
+// empty if the server does not require session tokens.
+type jsonSession struct {
+	Session string `json:"session"`
+	Name    string `json:"name"`
+	Token   string `json:"token,omitempty"`
+}
@@ -0,0 +1,96 @@
+package room
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSessionRegistry(t *testing.T) {
+	r := NewSessionRegistry()
+	meta := map[string]string{"color": "red"}
+	alice := r.Create("alice", meta)
+	meta["color"] = "blue"
+	if alice.ID == "" {
+		t.Fatalf("no session id assigned")
+	}
+	bob := r.Create("bob", nil)
+	if bob.ID == alice.ID {
+		t.Errorf("duplicate session id: %q", bob.ID)
+	}
+
+	info, ok := r.Lookup(alice.ID)
+	if !ok {
+		t.Fatalf("session not found")
+	}
+	if info.Name != "alice" || info.Metadata["color"] != "red" {
+		t.Errorf("session: %#v", info)
+	}
+	info.Metadata["color"] = "green"
+	if !r.SetMetadata(alice.ID, "team", "1") {
+		t.Errorf("metadata not set")
+	}
+	info, _ = r.Lookup(alice.ID)
+	if info.Metadata["color"] != "red" || info.Metadata["team"] != "1" {
+		t.Errorf("metadata: %v", info.Metadata)
+	}
+
+	seen := alice.LastSeen.Add(time.Second)
+	r.touch(alice.ID, seen)
+	r.touch("restored", seen)
+	info, _ = r.Lookup(alice.ID)
+	if !info.LastSeen.Equal(seen) {
+		t.Errorf("last seen: %v (!= %v)", info.LastSeen, seen)
+	}
+
+	sessions := r.Sessions()
+	if len(sessions) != 3 {
+		t.Fatalf("sessions: %d", len(sessions))
+	}
+	if sessions[0].ID != alice.ID || sessions[1].ID != bob.ID || sessions[2].ID != "restored" {
+		t.Errorf("sessions not ordered by join time")
+	}
+
+	r.Remove(bob.ID)
+	if _, ok := r.Lookup(bob.ID); ok {
+		t.Errorf("session not removed")
+	}
+}
+
+func TestCreateSession(t *testing.T) {
+	infos := make(chan *SessionInfo, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		info, _ := LookupSession(ctx, msg.Session())
+		infos <- info
+	}))
+	defer b.close()
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	c := testClient(t, s, nil)
+	err := c.CreateSessionMetadata(context.Background(), "player", map[string]string{"color": "red"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Session == "" {
+		t.Fatalf("no session assigned")
+	}
+	err = c.Send(context.Background(), String("test content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-infos:
+		if info == nil {
+			t.Fatalf("session not registered")
+		}
+		if info.ID != c.Session || info.Name != "player" || info.Metadata["color"] != "red" {
+			t.Errorf("session: %#v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("message not received")
+	}
+}
@@ -0,0 +1,181 @@
+package room
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// ErrClosed is returned by a Bus once it has begun shutting down or has been
+// closed.  Clients receive ErrClosed when the server closes the room.
+var ErrClosed = errors.New("room closed")
+
+// drain counts the operations in progress on a Bus or Server so that they can
+// finish before it shuts down.
+type drain struct {
+	mut     sync.Mutex
+	n       int
+	closing bool
+	done    chan struct{}
+}
+
+func newDrain() *drain {
+	return &drain{done: make(chan struct{})}
+}
+
+// add begins an operation.  If d is closing add returns false and the
+// operation must not proceed.
+func (d *drain) add() bool {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.closing {
+		return false
+	}
+	d.n++
+	return true
+}
+
+// release ends an operation begun with add.
+func (d *drain) release() {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.n--
+	if d.closing && d.n == 0 {
+		close(d.done)
+	}
+}
+
+// close prevents new operations from beginning and returns a channel which is
+// closed once all operations in progress have ended.
+func (d *drain) close() <-chan struct{} {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if !d.closing {
+		d.closing = true
+		if d.n == 0 {
+			close(d.done)
+		}
+	}
+	return d.done
+}
+
+// send passes env to the message loop.  Once b begins shutting down send
+// returns ErrClosed.
+func (b *Bus) send(ctx context.Context, env *envelope) error {
+	if !b.pending.add() {
+		return ErrClosed
+	}
+	select {
+	case b.msgs <- env:
+		return nil
+	case <-ctx.Done():
+		b.pending.release()
+		return ctx.Err()
+	case <-b.term:
+		b.pending.release()
+		return ErrClosed
+	}
+}
+
+// Close terminates b immediately.  Subscriptions are terminated with
+// ErrClosed and messages which have not been handled are discarded.
+func (b *Bus) Close() {
+	b.pending.close()
+	b.close()
+}
+
+// Shutdown gracefully terminates b.  New messages are rejected with ErrClosed
+// while messages already sent to b are handled, after which b is closed.  If
+// ctx is done before all messages are handled b is closed anyway and
+// Shutdown returns ctx.Err().  Handlers may broadcast events until b is
+// closed.  Shutdown returns once the event stores of b have been closed.
+func (b *Bus) Shutdown(ctx context.Context) error {
+	var err error
+	select {
+	case <-b.pending.close():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	b.close()
+	<-b.closed
+	return err
+}
+
+// SetDiscovery registers the mDNS server advertising s so that it is stopped
+// when s shuts down.
+func (s *Server) SetDiscovery(d Discovery) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.disco = d
+}
+
+// Shutdown gracefully stops s.  The registered Discovery server is stopped and
+// s stops accepting connections and requests.  Messages already received are
+// handled, then the Bus is closed and clients receiving events are notified
+// that the room closed.  Shutdown returns once all requests have completed.
+// If ctx is done first Shutdown returns ctx.Err() without waiting further.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mut.Lock()
+	disco := s.disco
+	s.disco = nil
+	if !s.closed {
+		s.closed = true
+		if s.tcp != nil {
+			s.tcp.Close()
+		}
+	}
+	s.mut.Unlock()
+
+	if disco != nil {
+		err := disco.Close()
+		if err != nil {
+			log.Printf("[ERR] Failed to stop discovery server: %v", err)
+		}
+	}
+	requests := s.handler.requests.close()
+	err := s.bus().Shutdown(ctx)
+	select {
+	case <-requests:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// isClosed returns true if s has been shut down.
+func (s *Server) isClosed() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.closed
+}
+
+func jsonClosed() string {
+	return jsonError("room_closed", ErrClosed.Error())
+}
+
+// jsonTerminated returns the final message sent to a client whose
+// subscription terminated with err.  If the client is not notified of err
+// jsonTerminated returns an empty string.
+func jsonTerminated(err error) string {
+	switch err {
+	case ErrSessionKicked:
+		return jsonKicked()
+	case ErrClosed:
+		return jsonClosed()
+	}
+	return ""
+}
+
+// writeClosed responds to a request received after the server began shutting
+// down.
+func writeClosed(w http.ResponseWriter) {
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, jsonClosed())
+}
@@ -0,0 +1,154 @@
+package room
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusShutdown(t *testing.T) {
+	var mut sync.Mutex
+	handled := 0
+	release := make(chan struct{})
+	h := hfunc(func(ctx context.Context, msg Msg) {
+		<-release
+		mut.Lock()
+		handled++
+		mut.Unlock()
+	})
+	b := NewBusConfig(context.Background(), &BusConfig{Workers: 1}, h)
+	sub := b.Subscribe(0)
+	defer b.Unsubscribe(sub)
+
+	for i := 0; i < 3; i++ {
+		err := b.Message("s", String(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- b.Shutdown(context.Background()) }()
+	timeout := time.After(time.Second)
+	for b.Message("s", String("late")) != ErrClosed {
+		select {
+		case <-timeout:
+			t.Fatalf("messages accepted after shutdown")
+		default:
+		}
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown before messages were handled: %v", err)
+	default:
+	}
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("shutdown: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("shutdown timeout")
+	}
+	mut.Lock()
+	if handled < 3 {
+		t.Errorf("handled: %d", handled)
+	}
+	mut.Unlock()
+
+	if err := b.Event(String("after close")); err != ErrClosed {
+		t.Errorf("event: %v", err)
+	}
+	if sub.Next(time.After(time.Second)) {
+		t.Errorf("event received after close")
+	}
+	if sub.Err() != ErrClosed {
+		t.Errorf("subscription error: %v", sub.Err())
+	}
+}
+
+func TestBusShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		<-release
+	}))
+	go b.Message("s", String("stuck"))
+	for len(b.Presence()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := b.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("shutdown: %v", err)
+	}
+	if err := b.Message("s", String("late")); err != ErrClosed {
+		t.Errorf("message: %v", err)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	b := NewBus(context.Background())
+	s := NewServer(&ServerConfig{
+		Room: &Room{Name: "test"},
+		Bus:  b,
+		Addr: "127.0.0.1:0",
+	})
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error, 1)
+	go func() { waited <- s.Wait() }()
+
+	host, port, err := net.SplitHostPort(s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(ehfunc(func(ctx context.Context, c *Client, ev Event) {}))
+	c.Host = host
+	c.Port, _ = strconv.Atoi(port)
+	err = c.CreateSession(context.Background(), "player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan error, 1)
+	go func() {
+		_, err := c.RunSupervised(context.Background(), 0, &ReconnectConfig{MinBackoff: time.Millisecond})
+		ran <- err
+	}()
+	for len(b.Presence()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	select {
+	case err := <-ran:
+		if err != ErrClosed {
+			t.Errorf("client: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client not notified")
+	}
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Errorf("wait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("server still running")
+	}
+}
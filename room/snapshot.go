@@ -0,0 +1,147 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNoSnapshot is returned by Bus.Snapshot when the application has not
+// registered a Snapshotter.
+var ErrNoSnapshot = errors.New("no snapshot provider")
+
+// Snapshotter is implemented by applications which can summarize their state
+// so that new clients may catch up without replaying the entire event log.
+type Snapshotter interface {
+	// Snapshot returns the current application state.  Snapshot is called by
+	// the bus between message handlers so the state it returns must reflect
+	// all events broadcast before it was called.
+	Snapshot(ctx context.Context) (Content, error)
+}
+
+// snapshotFunc implements Snapshotter
+type snapshotFunc func(context.Context) (Content, error)
+
+func (fn snapshotFunc) Snapshot(ctx context.Context) (Content, error) {
+	return fn(ctx)
+}
+
+// Snapshot is application state produced by a Snapshotter.  A snapshot
+// reflects all events with indices less than Next.  Clients applying a
+// snapshot should begin consuming the event log at Next.
+type Snapshot struct {
+	Next uint64
+	Time Time
+	Content
+}
+
+type snapshotResult struct {
+	snap *Snapshot
+	err  error
+}
+
+// SetSnapshotter registers s as the provider of application state for the
+// /rex/v0/state endpoint.  SetSnapshotter may be called from a Handler.
+func (b *Bus) SetSnapshotter(s Snapshotter) {
+	b.snapmut.Lock()
+	defer b.snapmut.Unlock()
+	b.snapper = s
+	b.snapgen++
+	b.snapshot = nil
+}
+
+// Snapshot returns the most recent snapshot of application state.  If events
+// have been broadcast since the last snapshot was taken a new snapshot is
+// requested from the registered Snapshotter.  Snapshot returns ErrNoSnapshot
+// if no Snapshotter has been registered.
+func (b *Bus) Snapshot() (*Snapshot, error) {
+	c := make(chan snapshotResult, 1)
+	select {
+	case <-b.term:
+		return nil, ErrClosed
+	case b.snapreq <- c:
+		r := <-c
+		return r.snap, r.err
+	}
+}
+
+// takeSnapshot must only be called from b.msgLoop.  Holding b.hmut waits for
+// any handlers running on workers to return.
+func (b *Bus) takeSnapshot() snapshotResult {
+	b.hmut.Lock()
+	defer b.hmut.Unlock()
+	b.snapmut.Lock()
+	snapper, gen, snapshot := b.snapper, b.snapgen, b.snapshot
+	b.snapmut.Unlock()
+	if snapper == nil {
+		return snapshotResult{err: ErrNoSnapshot}
+	}
+	next := b.next()
+	if snapshot != nil && snapshot.Next == next {
+		return snapshotResult{snap: snapshot}
+	}
+	c, err := snapper.Snapshot(withBus(b.ctx, b))
+	if err != nil {
+		return snapshotResult{err: err}
+	}
+	snapshot = &Snapshot{
+		Next:    next,
+		Time:    b.clock.Now(),
+		Content: c,
+	}
+	b.snapmut.Lock()
+	if b.snapgen == gen {
+		b.snapshot = snapshot
+	}
+	b.snapmut.Unlock()
+	if b.retention.Snapshot {
+		b.Compact(next)
+	}
+	return snapshotResult{snap: snapshot}
+}
+
+type jsonSnapshot struct {
+	N         uint64 `json:"next"`
+	T         Time   `json:"time"`
+	D         string `json:"data"`
+	E         string `json:"encoding,omitempty"` // the encoding of D, if any
+	Y         string `json:"type,omitempty"`     // the content type of D, if any
+	*Snapshot `json:"-"`
+}
+
+func newJSONSnapshot(snap *Snapshot) *jsonSnapshot {
+	if snap == nil {
+		return &jsonSnapshot{}
+	}
+	js := &jsonSnapshot{
+		N: snap.Next,
+		T: snap.Time,
+	}
+	js.D, js.E = encodeContent(snap)
+	js.Y = ContentType(snap)
+	return js
+}
+
+func (snap *jsonSnapshot) MarshalJSON() ([]byte, error) {
+	type S jsonSnapshot
+	return json.Marshal((*S)(snap))
+}
+
+func (snap *jsonSnapshot) UnmarshalJSON(b []byte) error {
+	type S jsonSnapshot
+	err := json.Unmarshal(b, (*S)(snap))
+	if err != nil {
+		return err
+	}
+	c, err := decodeContent(snap.D, snap.E, snap.Y)
+	if err != nil {
+		return err
+	}
+	snap.Snapshot = &Snapshot{
+		Next:    snap.N,
+		Time:    snap.T,
+		Content: c,
+	}
+	return nil
+}
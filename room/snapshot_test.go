@@ -0,0 +1,77 @@
+package room
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusSnapshot(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	_, err := b.Snapshot()
+	if err != ErrNoSnapshot {
+		t.Errorf("snapshot: %v", err)
+	}
+
+	n := 0
+	b.SetSnapshotter(snapshotFunc(func(ctx context.Context) (Content, error) {
+		n++
+		return String("test state"), nil
+	}))
+
+	b.Event(String("test content"))
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if snap.Next != 1 {
+		t.Errorf("next: %d", snap.Next)
+	}
+	if snap.Text() != "test state" {
+		t.Errorf("content: %v", snap.Text())
+	}
+
+	_, err = b.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("snapshots taken: %d", n)
+	}
+
+	b.Event(String("test content"))
+	snap, err = b.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if snap.Next != 2 {
+		t.Errorf("next: %d", snap.Next)
+	}
+	if n != 2 {
+		t.Errorf("snapshots taken: %d", n)
+	}
+}
+
+func TestBusSetSnapshotterFromHandler(t *testing.T) {
+	var b *Bus
+	b = NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		b.SetSnapshotter(snapshotFunc(func(ctx context.Context) (Content, error) {
+			return String("test state"), nil
+		}))
+	}))
+	defer b.close()
+
+	err := b.Deliver(context.Background(), &Delivery{Session: "s", Content: String("start"), Wait: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := b.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if snap.Text() != "test state" {
+		t.Errorf("content: %v", snap.Text())
+	}
+}
@@ -0,0 +1,67 @@
+package room
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsEventStream returns true if r is a request for a Server-Sent Events
+// stream, as made by an EventSource in a web browser.
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediatype == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// lastEventStart returns the start index for an EventSource which is
+// reconnecting after receiving the event identified by the Last-Event-ID
+// header in r.  If r has no Last-Event-ID header lastEventStart returns false.
+func lastEventStart(r *http.Request) (start int, ok bool, err error) {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		return 0, false, nil
+	}
+	i, err := strconv.ParseUint(id, 10, 63)
+	if err != nil {
+		return 0, false, err
+	}
+	return int(i) + 1, true, nil
+}
+
+// serveEventStream writes events from sub to w using the Server-Sent Events
+// format.  The id of each event is its index and events on a topic other
+// than the default have the topic as their event type.  Unlike the json stream
+// the response remains open until the client disconnects or sub terminates.
+func serveEventStream(w http.ResponseWriter, sub *Subscription) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	streamEvents(w, sub, sseHeartbeat, func(event Event) error {
+		data, err := json.Marshal(newJSONEvent(event))
+		if err != nil {
+			return err
+		}
+		if event.Topic() != "" {
+			_, err = fmt.Fprintf(w, "event: %s\n", event.Topic())
+			if err != nil {
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.Index(), data)
+		return err
+	})
+	if frame := jsonTerminated(sub.Err()); frame != "" {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", frame)
+	}
+}
+
+// sseHeartbeat is a comment, which is ignored by EventSource objects.
+var sseHeartbeat = []byte(":\n\n")
@@ -0,0 +1,75 @@
+package room
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestHTTPBusEventStream(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	for i := 0; i < 3; i++ {
+		b.Event(String(fmt.Sprintf("test content %d", i)))
+	}
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	req, err := http.NewRequest("GET", s.URL+"/rex/v0/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: %s", resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("content-type: %q", resp.Header.Get("Content-Type"))
+	}
+
+	r := bufio.NewReader(resp.Body)
+	readLine := func() string {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+	if line := readLine(); line != "id: 2" {
+		t.Errorf("id: %q", line)
+	}
+	line := readLine()
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("data: %q", line)
+	}
+	e := map[string]interface{}{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if e["index"] != float64(2) || e["data"] != "test content 2" {
+		t.Errorf("event: %v", e)
+	}
+	if line := readLine(); line != "" {
+		t.Errorf("terminator: %q", line)
+	}
+
+	// the stream must remain open for events broadcast later.
+	b.Event(String("test content 3"))
+	if line := readLine(); line != "id: 3" {
+		t.Errorf("id: %q", line)
+	}
+}
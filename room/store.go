@@ -0,0 +1,403 @@
+package room
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// EventStore holds the event log for a Bus.  A Bus serializes calls to its
+// EventStore so implementations need not be safe for concurrent use.
+type EventStore interface {
+	// Append adds event to the end of the log.  The index of event is always
+	// equal to the value returned by Next.
+	Append(event Event) error
+
+	// First returns the index of the earliest event in the store.
+	First() uint64
+
+	// Next returns the index which will be assigned to the next event
+	// appended to the store.
+	Next() uint64
+
+	// Events returns the events in the store beginning at index start.
+	// Events in the returned slice must not be modified by later calls to
+	// Append or Truncate.
+	Events(start uint64) ([]Event, error)
+
+	// Truncate drops all events with indices less than next.
+	Truncate(next uint64) error
+
+	// Close releases resources held by the store.
+	Close() error
+}
+
+// NewMemStore returns an EventStore which keeps events in memory only.
+func NewMemStore() EventStore {
+	return &memStore{}
+}
+
+type memStore struct {
+	first  uint64
+	events []Event
+}
+
+var _ EventStore = &memStore{}
+
+func (s *memStore) Append(event Event) error {
+	if event.Index() != s.Next() {
+		return fmt.Errorf("event index %d is not the next index %d", event.Index(), s.Next())
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+func (s *memStore) First() uint64 {
+	return s.first
+}
+
+func (s *memStore) Next() uint64 {
+	return s.first + uint64(len(s.events))
+}
+
+func (s *memStore) Events(start uint64) ([]Event, error) {
+	if start < s.first {
+		return nil, &CompactedError{First: s.first}
+	}
+	if start >= s.Next() {
+		return nil, nil
+	}
+	return s.events[start-s.first:], nil
+}
+
+func (s *memStore) Truncate(next uint64) error {
+	if next > s.Next() {
+		next = s.Next()
+	}
+	if next <= s.first {
+		return nil
+	}
+	s.events = s.events[next-s.first:]
+	s.first = next
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// OpenFileStore opens an append-only event log stored in the file at path,
+// creating it if it does not exist.  Events previously written to the file are
+// loaded so a Bus using the store resumes with the same event indices it had
+// before the process exited.  Each event is synced to disk before Append
+// returns.
+//
+// Events are retained in memory as well as in the file.  Truncating the store
+// appends a record of the new first index to the file.  Once most of the file
+// holds truncated events it is rewritten in the background and replaced
+// atomically.
+func OpenFileStore(path string) (EventStore, error) {
+	s := &fileStore{path: path}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fileStoreRewriteMin is the number of obsolete records a file store holds
+// before it is rewritten.
+var fileStoreRewriteMin = 1024
+
+type fileStore struct {
+	memStore
+	path string
+
+	// mut protects the fields below, and memStore, from the goroutine
+	// rewriting the file.
+	mut       sync.Mutex
+	f         *os.File
+	w         *bufio.Writer
+	obsolete  int  // records in f which are truncated events or tombstones
+	rewriting bool // a rewrite is in progress
+	done      sync.WaitGroup
+}
+
+var _ EventStore = &fileStore{}
+
+// fileHeader is the first record in a file store.  It allows the log to be
+// restored with the correct indices even when all of its events have been
+// truncated.  Records of the same form are appended, as tombstones, when the
+// store is truncated.
+type fileHeader struct {
+	First *uint64 `json:"first"`
+}
+
+func (s *fileStore) load() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		// the file is new and must have a header written.
+		f.Close()
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		return s.replaceLocked(s.writeTemp(s.first, nil))
+	}
+	var header fileHeader
+	if err == nil {
+		err = json.Unmarshal(line, &header)
+	}
+	if err == nil && header.First == nil {
+		err = fmt.Errorf("missing first index")
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: invalid header: %v", s.path, err)
+	}
+	s.first = *header.First
+
+	// Each record is written on its own line.  Anything following the last
+	// complete record was partially written when the process exited and is
+	// discarded.
+	valid := int64(len(line))
+	for {
+		line, err = r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var tombstone fileHeader
+		err = json.Unmarshal(line, &tombstone)
+		if err != nil {
+			break
+		}
+		if tombstone.First != nil {
+			first := s.first
+			s.memStore.Truncate(*tombstone.First)
+			s.obsolete += int(s.first-first) + 1
+			valid += int64(len(line))
+			continue
+		}
+		ejs := newJSONEvent(nil)
+		err = json.Unmarshal(line, ejs)
+		if err != nil {
+			break
+		}
+		err = s.memStore.Append(ejs.Event)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %v", s.path, err)
+		}
+		valid += int64(len(line))
+	}
+	err = f.Truncate(valid)
+	if err == nil {
+		_, err = f.Seek(valid, 0)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.w = bufio.NewWriter(f)
+	return nil
+}
+
+func (s *fileStore) Append(event Event) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	err := s.memStore.Append(event)
+	if err != nil {
+		return err
+	}
+	return s.writeLocked(newJSONEvent(event))
+}
+
+func (s *fileStore) Events(start uint64) ([]Event, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.memStore.Events(start)
+}
+
+// Truncate drops events from memory and records the new first index in the
+// file.  The file is rewritten in the background once enough of it is
+// obsolete.
+func (s *fileStore) Truncate(next uint64) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	first := s.first
+	err := s.memStore.Truncate(next)
+	if err != nil {
+		return err
+	}
+	if s.first == first {
+		return nil
+	}
+	err = s.writeLocked(&fileHeader{First: &s.first})
+	if err != nil {
+		return err
+	}
+	s.obsolete += int(s.first-first) + 1
+	if !s.rewriting && s.obsolete >= fileStoreRewriteMin && s.obsolete >= len(s.events) {
+		s.rewriting = true
+		s.done.Add(1)
+		go s.rewrite(s.first, s.events)
+	}
+	return nil
+}
+
+// writeLocked appends a record to the file and syncs it.  The caller must hold
+// s.mut.
+func (s *fileStore) writeLocked(record interface{}) error {
+	if s.f == nil {
+		return fmt.Errorf("%s: store closed", s.path)
+	}
+	err := json.NewEncoder(s.w).Encode(record)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err == nil {
+		err = s.f.Sync()
+	}
+	return err
+}
+
+// rewrite replaces the file with one containing only events, beginning at
+// index first.  Events appended and truncations made while the file is being
+// written are copied to it before it replaces the old file.
+func (s *fileStore) rewrite(first uint64, events []Event) {
+	defer s.done.Done()
+	tmp := s.writeTemp(first, events)
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.rewriting = false
+	if s.f == nil {
+		tmp.discard()
+		return
+	}
+	obsolete := 0
+	if s.first != first {
+		tmp.encode(&fileHeader{First: &s.first})
+		obsolete = int(s.first-first) + 1
+	}
+	next := first + uint64(len(events))
+	if next < s.first {
+		next = s.first
+	}
+	for _, event := range s.events[next-s.first:] {
+		tmp.encode(newJSONEvent(event))
+	}
+	err := s.replaceLocked(tmp)
+	if err != nil {
+		log.Printf("[ERR] Failed to rewrite event store %s: %v", s.path, err)
+		return
+	}
+	s.obsolete = obsolete
+}
+
+// tempFile is a replacement for the file of a fileStore being written.  The
+// first error encountered is retained and later writes are skipped.
+type tempFile struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	err error
+}
+
+// writeTemp writes a header with index first and events to a new temporary
+// file.  It does not access s.memStore, so s.mut need not be held.
+func (s *fileStore) writeTemp(first uint64, events []Event) *tempFile {
+	dir, name := filepath.Split(s.path)
+	tmp := &tempFile{}
+	tmp.f, tmp.err = os.OpenFile(filepath.Join(dir, "."+name+".tmp"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if tmp.err != nil {
+		return tmp
+	}
+	tmp.w = bufio.NewWriter(tmp.f)
+	tmp.enc = json.NewEncoder(tmp.w)
+	tmp.encode(&fileHeader{First: &first})
+	for _, event := range events {
+		tmp.encode(newJSONEvent(event))
+	}
+	return tmp
+}
+
+func (tmp *tempFile) encode(record interface{}) {
+	if tmp.err == nil {
+		tmp.err = tmp.enc.Encode(record)
+	}
+}
+
+func (tmp *tempFile) discard() {
+	if tmp.f != nil {
+		tmp.f.Close()
+		os.Remove(tmp.f.Name())
+	}
+}
+
+// replaceLocked syncs tmp and atomically replaces the file of s with it.  The
+// caller must hold s.mut.
+func (s *fileStore) replaceLocked(tmp *tempFile) error {
+	err := tmp.err
+	if err == nil {
+		err = tmp.w.Flush()
+	}
+	if err == nil {
+		err = tmp.f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.f.Name(), s.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(s.path))
+	}
+	if err != nil {
+		tmp.discard()
+		return err
+	}
+	if s.f != nil {
+		s.f.Close()
+	}
+	s.f = tmp.f
+	s.w = tmp.w
+	return nil
+}
+
+// syncDir syncs the directory at path so that a file renamed into it persists.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close waits for any rewrite of the file to finish and closes it.
+func (s *fileStore) Close() error {
+	s.done.Wait()
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Flush()
+	if err == nil {
+		err = s.f.Sync()
+	}
+	cerr := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+	return cerr
+}
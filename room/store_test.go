@@ -0,0 +1,197 @@
+package room
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rex-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := uint64(0); i < 5; i++ {
+		err = s.Append(newEvent(i, String("test content"), new(Clock).Now))
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	err = s.Truncate(2)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	err = s.Append(newTopicEvent(PrivateTopic, 5, String("last content"), new(Clock).Now))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"index":6,"ti`)
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if s.First() != 2 {
+		t.Errorf("first: %d", s.First())
+	}
+	if s.Next() != 6 {
+		t.Errorf("next: %d", s.Next())
+	}
+	events, err := s.Events(2)
+	if err != nil {
+		t.Fatalf("events: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("events: %d", len(events))
+	}
+	if events[3].Index() != 5 || events[3].Text() != "last content" {
+		t.Errorf("event: %d %q", events[3].Index(), events[3].Text())
+	}
+	if events[3].Topic() != PrivateTopic {
+		t.Errorf("topic: %q", events[3].Topic())
+	}
+	_, err = s.Events(1)
+	if _, ok := err.(*CompactedError); !ok {
+		t.Errorf("events: %v", err)
+	}
+	err = s.Append(newEvent(6, String("test content"), new(Clock).Now))
+	if err != nil {
+		t.Errorf("append: %v", err)
+	}
+}
+
+func TestBusFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rex-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	b := NewBusConfig(context.Background(), &BusConfig{Store: s})
+	b.Event(String("test content"))
+	b.Event(String("test content"))
+	err = b.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	b = NewBusConfig(context.Background(), &BusConfig{Store: s})
+	defer b.close()
+	b.Event(String("restarted content"))
+
+	sub := b.Subscribe(1)
+	defer b.Unsubscribe(sub)
+	for i := uint64(1); i < 3; i++ {
+		if !sub.Next(time.After(time.Second)) {
+			t.Fatalf("no event %d: %v", i, sub.Err())
+		}
+		if sub.Event().Index() != i {
+			t.Errorf("index: %d (!= %d)", sub.Event().Index(), i)
+		}
+	}
+	if sub.Event().Text() != "restarted content" {
+		t.Errorf("content: %q", sub.Event().Text())
+	}
+}
+
+func TestFileStoreRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rex-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.log")
+	defer func(n int) { fileStoreRewriteMin = n }(fileStoreRewriteMin)
+	fileStoreRewriteMin = 8
+
+	lines := func() int {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(b, []byte("\n"))
+	}
+
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		err = s.Append(newEvent(i, String("test content"), new(Clock).Now))
+		if err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+
+	// a small truncation only appends a tombstone.
+	err = s.Truncate(3)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if n := lines(); n != 12 {
+		t.Errorf("lines after truncate: %d", n)
+	}
+
+	// the file is rewritten once most of it is obsolete.
+	err = s.Truncate(9)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	err = s.Append(newEvent(10, String("last content"), new(Clock).Now))
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if n := lines(); n > 4 {
+		t.Errorf("lines after rewrite: %d", n)
+	}
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	if s.First() != 9 || s.Next() != 11 {
+		t.Errorf("first: %d next: %d", s.First(), s.Next())
+	}
+	events, err := s.Events(9)
+	if err != nil || len(events) != 2 || events[1].Text() != "last content" {
+		t.Errorf("events: %v %v", events, err)
+	}
+}
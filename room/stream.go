@@ -0,0 +1,128 @@
+package room
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// heartbeatInterval is the maximum amount of time a long-lived event stream
+// remains silent.  Clients may assume a connection has failed if they receive
+// nothing for several intervals.
+var heartbeatInterval = 15 * time.Second
+
+// clientIdleTimeout is the amount of time a client waits for data on a
+// long-lived event stream before assuming the connection has failed.
+var clientIdleTimeout = 3 * heartbeatInterval
+
+// jsonHeartbeat is whitespace, which is skipped by json decoders.
+var jsonHeartbeat = []byte("\n")
+
+// streamEvents passes events from sub to write, flushing w after each one,
+// until the client disconnects or sub terminates.  When no event has been
+// written for heartbeatInterval the heartbeat is written to w so the client
+// knows the connection is alive.
+func streamEvents(w http.ResponseWriter, sub *Subscription, heartbeat []byte, write func(Event) error) {
+	flush := func() {}
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	flush()
+
+	// stop is closed when the client disconnects to terminate the event
+	// loop.
+	var stop <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		stop = cn.CloseNotify()
+	}
+
+	// A stale value left in timer.C after a reset causes at most one
+	// unnecessary heartbeat, which is harmless.
+	timer := time.NewTimer(heartbeatInterval)
+	defer timer.Stop()
+	for {
+		ok, ticked := sub.wait(stop, timer.C)
+		if ticked {
+			_, err := w.Write(heartbeat)
+			if err != nil {
+				return
+			}
+		} else if !ok {
+			return
+		} else {
+			err := write(sub.Event())
+			if err != nil {
+				log.Printf("[INFO] Failed to deliver event to client: %v", err)
+				return
+			}
+		}
+		flush()
+		timer.Reset(heartbeatInterval)
+	}
+}
+
+// wait is like Next but waits until either an event is received, stop is
+// closed or a value is received from tick.  If a value is received from tick
+// wait returns false and true.
+func (s *Subscription) wait(stop <-chan bool, tick <-chan time.Time) (ok, ticked bool) {
+	c := make(chan Event)
+	select {
+	case <-stop:
+		return false, false
+	case <-tick:
+		return false, true
+	case <-s.term:
+		return false, false
+	case s.req <- c:
+		s.event, ok = <-c
+		return ok, false
+	}
+}
+
+// errIdle is returned by an idleReader which has been closed after its
+// timeout elapsed.
+var errIdle = errors.New("connection idle")
+
+// idleReader closes the underlying reader if no data has been read for a
+// period of time.
+type idleReader struct {
+	r       io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	mut     sync.Mutex
+	idle    bool
+}
+
+func newIdleReader(r io.ReadCloser, timeout time.Duration) *idleReader {
+	ir := &idleReader{r: r, timeout: timeout}
+	ir.timer = time.AfterFunc(timeout, func() {
+		ir.mut.Lock()
+		ir.idle = true
+		ir.mut.Unlock()
+		r.Close()
+	})
+	return ir
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil {
+		r.mut.Lock()
+		if r.idle {
+			err = errIdle
+		}
+		r.mut.Unlock()
+	}
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	return r.r.Close()
+}
@@ -0,0 +1,98 @@
+package room
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHTTPBusEventsStream(t *testing.T) {
+	defer func(d time.Duration) { heartbeatInterval = d }(heartbeatInterval)
+	heartbeatInterval = 20 * time.Millisecond
+
+	b := NewBus(context.Background())
+	defer b.close()
+	b.Event(String("test content"))
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/rex/v0/events?stream=true")
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: %s", resp.Status)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if line == "\n" {
+		t.Errorf("heartbeat before first event")
+	}
+
+	// nothing is broadcast so a heartbeat must be received.
+	line, err = r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if line != "\n" {
+		t.Errorf("heartbeat: %q", line)
+	}
+}
+
+func TestClientRunStream(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	events := make(chan Event)
+	c := testClient(t, s, ehfunc(func(ctx context.Context, c *Client, event Event) {
+		events <- event
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		next, err := c.Run(ctx, 0)
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+		done <- next
+	}()
+
+	// each event must be handled as soon as it is broadcast, while the
+	// response is still open.
+	for i := uint64(0); i < 3; i++ {
+		b.Event(String("test content"))
+		select {
+		case event := <-events:
+			if event.Index() != i {
+				t.Errorf("index: %d (!= %d)", event.Index(), i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout receiving event %d", i)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case next := <-done:
+		if next != 3 {
+			t.Errorf("next: %d", next)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout terminating client")
+	}
+}
@@ -1,32 +1,174 @@
 package room
 
 import (
-	"encoding/binary"
-	"encoding/hex"
-	"sync/atomic"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-var dt = &dumbTime{}
+// Time is a timestamp issued by a hybrid logical clock.  Wall approximates
+// physical time in milliseconds since the Unix epoch and Logical orders
+// timestamps sharing a Wall value.  Unlike physical timestamps, a Time issued
+// after receiving a message or event is always later than the Time of that
+// message or event, even when the clocks of the client and server disagree.
+// The zero Time means the time is unknown.
+//
+// A Time is encoded in JSON as a string containing the decimal Wall and
+// Logical components separated by a colon, "1453520000000:2".
+type Time struct {
+	Wall    int64
+	Logical uint32
+}
+
+// ParseTime parses the string encoding of a Time.  A string without a
+// Logical component is accepted with a Logical component of zero.
+func ParseTime(s string) (Time, error) {
+	var t Time
+	wall, logical := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		wall, logical = s[:i], s[i+1:]
+	}
+	var err error
+	t.Wall, err = strconv.ParseInt(wall, 10, 64)
+	if err != nil {
+		return Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	if logical != "" {
+		l, err := strconv.ParseUint(logical, 10, 32)
+		if err != nil {
+			return Time{}, fmt.Errorf("invalid time %q", s)
+		}
+		t.Logical = uint32(l)
+	}
+	return t, nil
+}
 
-// Time has not been figured out yet.  It is definitely an abstract time.  I
-// would like it if all events and messages had unique identifiers.
-type Time interface{}
+// IsZero returns true if t is the zero Time.
+func (t Time) IsZero() bool {
+	return t == Time{}
+}
+
+// Before returns true if t is earlier than u.
+func (t Time) Before(u Time) bool {
+	return t.Wall < u.Wall || (t.Wall == u.Wall && t.Logical < u.Logical)
+}
 
-type dumbTime struct {
-	t uint64
+// After returns true if t is later than u.
+func (t Time) After(u Time) bool {
+	return u.Before(t)
 }
 
-func (t *dumbTime) Now() Time {
-	now := atomic.AddUint64(&t.t, 1)
-	return t64(now)
+// Physical returns the physical time approximated by t.
+func (t Time) Physical() time.Time {
+	return time.Unix(0, t.Wall*int64(time.Millisecond))
 }
 
-type t64 uint64
+func (t Time) String() string {
+	return strconv.FormatInt(t.Wall, 10) + ":" + strconv.FormatUint(uint64(t.Logical), 10)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (t Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Messages and events from older
+// peers carry an opaque counter as a JSON number, which is decoded as a
+// Logical component with a Wall of zero.  Null and empty strings decode as
+// the zero Time.
+func (t *Time) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+		*t = Time{}
+	case float64:
+		*t = Time{Logical: uint32(v)}
+	case string:
+		if v == "" {
+			*t = Time{}
+			return nil
+		}
+		*t, err = ParseTime(v)
+		return err
+	default:
+		return fmt.Errorf("invalid time %s", b)
+	}
+	return nil
+}
+
+// MaxClockSkew is how far ahead of the bus clock's physical time the time of a
+// message may be, after translation by the sender's clock offset.  Later
+// times would drag the bus clock, and the time of every later event, into
+// the future.
+var MaxClockSkew = time.Minute
+
+// ErrTimeAhead is returned when the time of a message is more than
+// MaxClockSkew ahead of the bus clock.
+var ErrTimeAhead = errors.New("message time is too far in the future")
+
+// tick returns the earliest time after t.
+func (t Time) tick() Time {
+	if t.Logical == math.MaxUint32 {
+		return Time{Wall: t.Wall + 1}
+	}
+	t.Logical++
+	return t
+}
+
+// Clock is a hybrid logical clock.  The times it issues are strictly
+// increasing and stay close to physical time, while being later than any time
+// passed to Update.  The zero value is a clock ready to use.
+type Clock struct {
+	mut  sync.Mutex
+	last Time
+	now  func() time.Time // physical time, for testing
+}
+
+func (c *Clock) physical() int64 {
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	return now().UnixNano() / int64(time.Millisecond)
+}
+
+// Now returns a new time from c.
+func (c *Clock) Now() Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	pt := c.physical()
+	if pt > c.last.Wall {
+		c.last = Time{Wall: pt}
+	} else {
+		c.last = c.last.tick()
+	}
+	return c.last
+}
 
-func (t t64) String() string {
-	var buf1 [8]byte
-	var buf2 [16]byte
-	binary.BigEndian.PutUint64(buf1[:], uint64(t))
-	hex.Encode(buf2[:], buf1[:])
-	return string(buf2[:])
+// Update merges t, the time of a message or event received from another
+// clock, into c and returns a new time from c which is later than t.  If t
+// is zero Update is equivalent to Now.
+func (c *Clock) Update(t Time) Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	pt := c.physical()
+	last := c.last
+	switch {
+	case pt > last.Wall && pt > t.Wall:
+		c.last = Time{Wall: pt}
+	case t.After(last):
+		c.last = t.tick()
+	default:
+		c.last = last.tick()
+	}
+	return c.last
 }
@@ -1,22 +1,165 @@
 package room
 
-import "testing"
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
 
-func TestDumbTime(t *testing.T) {
-	dt := new(dumbTime)
-	t1 := dt.Now()
-	if t1.(t64) != 1 {
+	"golang.org/x/net/context"
+)
+
+// stoppedClock returns a Clock whose physical time is always t.
+func stoppedClock(t time.Time) *Clock {
+	return &Clock{now: func() time.Time { return t }}
+}
+
+func TestClockNow(t *testing.T) {
+	now := time.Unix(1453520000, 0)
+	clock := stoppedClock(now)
+	t1 := clock.Now()
+	if t1 != (Time{Wall: 1453520000000}) {
 		t.Errorf("t1: %v", t1)
 	}
-	t2 := dt.Now()
-	if t2.(t64) != 2 {
+	t2 := clock.Now()
+	if !t2.After(t1) || t2.Wall != t1.Wall {
 		t.Errorf("t2: %v", t2)
 	}
+	if !t1.Physical().Equal(now) {
+		t.Errorf("physical: %v", t1.Physical())
+	}
+
+	// physical time moving backwards does not move the clock backwards.
+	clock.now = func() time.Time { return now.Add(-time.Second) }
+	t3 := clock.Now()
+	if !t3.After(t2) {
+		t.Errorf("t3: %v", t3)
+	}
 }
 
-func TestT64(t *testing.T) {
-	t1 := t64(0xDEADBEEF12345678)
-	if t1.String() != "deadbeef12345678" {
-		t.Errorf("t1: %v", t1)
+func TestClockUpdate(t *testing.T) {
+	now := time.Unix(1453520000, 0)
+	for i, test := range []struct {
+		last   Time
+		remote Time
+		expect Time
+	}{
+		// the physical clock is ahead.
+		{Time{1453519999000, 4}, Time{1453519999500, 2}, Time{1453520000000, 0}},
+		// the remote clock is ahead.
+		{Time{1453520000000, 4}, Time{1453520001000, 2}, Time{1453520001000, 3}},
+		// the remote clock is behind.
+		{Time{1453520001000, 4}, Time{1453520000500, 9}, Time{1453520001000, 5}},
+		// the clocks agree.
+		{Time{1453520001000, 4}, Time{1453520001000, 9}, Time{1453520001000, 10}},
+		{Time{1453520001000, 4}, Time{1453520001000, 2}, Time{1453520001000, 5}},
+		// no remote time.
+		{Time{1453520001000, 4}, Time{}, Time{1453520001000, 5}},
+		// the logical component overflows.
+		{Time{1453520001000, 4}, Time{1453520001000, math.MaxUint32}, Time{1453520001001, 0}},
+		{Time{1453520001000, math.MaxUint32}, Time{}, Time{1453520001001, 0}},
+	} {
+		clock := stoppedClock(now)
+		clock.last = test.last
+		merged := clock.Update(test.remote)
+		if merged != test.expect {
+			t.Errorf("test %d: %v (!= %v)", i, merged, test.expect)
+		}
+		if !merged.After(test.remote) {
+			t.Errorf("test %d: %v not after %v", i, merged, test.remote)
+		}
+	}
+}
+
+func TestTimeJSON(t *testing.T) {
+	t1 := Time{Wall: 1453520000000, Logical: 7}
+	js, err := json.Marshal(t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(js) != `"1453520000000:7"` {
+		t.Errorf("json: %s", js)
+	}
+
+	for i, test := range []struct {
+		js     string
+		expect Time
+	}{
+		{`"1453520000000:7"`, t1},
+		{`"1453520000000"`, Time{Wall: 1453520000000}},
+		{`12`, Time{Logical: 12}},
+		{`""`, Time{}},
+		{`null`, Time{}},
+	} {
+		var t2 Time
+		err := json.Unmarshal([]byte(test.js), &t2)
+		if err != nil {
+			t.Errorf("test %d: %v", i, err)
+			continue
+		}
+		if t2 != test.expect {
+			t.Errorf("test %d: %v", i, t2)
+		}
+	}
+
+	for _, js := range []string{`"abc"`, `"12:x"`, `true`} {
+		var t2 Time
+		err := json.Unmarshal([]byte(js), &t2)
+		if err == nil {
+			t.Errorf("decoded %s as %v", js, t2)
+		}
+	}
+}
+
+func TestBusMessageTime(t *testing.T) {
+	msgs := make(chan Msg, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		msgs <- msg
+	}))
+	defer b.close()
+
+	// the sender's clock is ahead of the server.
+	sent := Time{Wall: millis(time.Now().Add(MaxClockSkew / 2))}
+	err := b.Deliver(context.Background(), &Delivery{Session: "s", Content: String("hi"), Time: sent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := <-msgs
+	if msg.Time() != sent {
+		t.Errorf("message time: %v", msg.Time())
+	}
+	if now := b.Now(); !now.After(sent) {
+		t.Errorf("bus time %v not after message time %v", now, sent)
+	}
+}
+
+func TestBusMessageTimeAhead(t *testing.T) {
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		t.Errorf("message handled: %v", msg.Time())
+	}))
+	defer b.close()
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	sent := Time{Wall: millis(time.Now().Add(time.Hour))}
+	err := b.Deliver(context.Background(), &Delivery{Session: "s", Content: String("hi"), Time: sent})
+	if err != ErrTimeAhead {
+		t.Errorf("deliver: %v", err)
+	}
+	if now := b.Now(); now.After(sent) {
+		t.Errorf("bus time %v moved to message time %v", now, sent)
+	}
+
+	body := `{"session":"s","data":"hi","time":"99999999999999:0"}`
+	resp, err := http.Post(s.URL+"/rex/v0/messages", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status: %v", resp.Status)
 	}
 }
@@ -0,0 +1,146 @@
+package room
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// PrivateTopic is the topic of events sent to specific sessions with EventTo.
+// Each session has its own log for the topic, with its own sequence of
+// indices, so the indices of the private events a session receives are
+// consecutive and reveal nothing about events sent to other sessions.
+const PrivateTopic = "@private"
+
+// ErrPrivateTopic is returned when an event is broadcast on PrivateTopic.
+var ErrPrivateTopic = errors.New("events on the private topic must be sent with EventTo")
+
+// eventLog is the retained history of events broadcast on a topic.  Each
+// topic has its own sequence of event indices.
+type eventLog struct {
+	events EventStore
+	at     []time.Time // The broadcast time of each event in events
+}
+
+func newEventLog(store EventStore) *eventLog {
+	elog := &eventLog{events: store}
+	// The broadcast time of events loaded from a persistent store is unknown
+	// so they are aged from the time the log is opened.
+	now := time.Now()
+	for i := store.First(); i < store.Next(); i++ {
+		elog.at = append(elog.at, now)
+	}
+	return elog
+}
+
+// logLocked returns the log for topic, or nil if no event has been broadcast
+// on topic.  The log of PrivateTopic is that of session.  The caller must hold
+// b.eventsrdy.L.
+func (b *Bus) logLocked(topic, session string) *eventLog {
+	if topic == PrivateTopic {
+		return b.private[session]
+	}
+	return b.logs[topic]
+}
+
+// openLogLocked returns the log for topic, opening its store if necessary.
+// The log of PrivateTopic is that of session, whose store is named by
+// PrivateTopic and session separated by a slash.  The caller must hold
+// b.eventsrdy.L.  Logs are only opened when events are broadcast so that
+// clients subscribing to arbitrary topics cannot make b allocate logs.
+func (b *Bus) openLogLocked(topic, session string) (*eventLog, error) {
+	elog := b.logLocked(topic, session)
+	if elog != nil {
+		return elog, nil
+	}
+	store := NewMemStore()
+	if b.topicStore != nil {
+		name := topic
+		if topic == PrivateTopic {
+			name = PrivateTopic + "/" + session
+		}
+		var err error
+		store, err = b.topicStore(name)
+		if err != nil {
+			return nil, err
+		}
+		b.resumeClock(store)
+	}
+	elog = newEventLog(store)
+	if topic == PrivateTopic {
+		b.private[session] = elog
+	} else {
+		b.logs[topic] = elog
+	}
+	return elog, nil
+}
+
+// EventOn is like Event but broadcasts the event on the named topic.  Only
+// subscriptions including topic receive the event.  The default topic is
+// named by the empty string.  Events cannot be broadcast on PrivateTopic.
+func (b *Bus) EventOn(topic string, c Content) error {
+	if topic == PrivateTopic {
+		return ErrPrivateTopic
+	}
+	return b.appendEvent(topic, nil, c)
+}
+
+// MessageOn is like Message but the message is sent on the named topic.
+func (b *Bus) MessageOn(topic string, session string, c Content) error {
+	return b.Deliver(context.Background(), &Delivery{
+		Topic:   topic,
+		Session: session,
+		Content: c,
+	})
+}
+
+// logCursor is the position of a Subscription in a topic.  The log of a topic
+// with no events yet is nil until an event is broadcast on it.
+type logCursor struct {
+	topic   string
+	session string // the session whose private log is read
+	log     *eventLog
+	i       uint64
+}
+
+// nextEventLocked returns the next event to deliver from cursors.  When
+// several topics have pending events the one broadcast first is returned.  If
+// no cursor has a pending event nextEventLocked returns a nil cursor.  The
+// caller must hold b.eventsrdy.L.
+func (b *Bus) nextEventLocked(cursors []*logCursor) (*logCursor, Event, error) {
+	var cur *logCursor
+	var event *simpleEvent
+	for _, c := range cursors {
+		if c.log == nil {
+			c.log = b.logLocked(c.topic, c.session)
+			if c.log == nil {
+				continue
+			}
+		}
+		first := c.log.events.First()
+		if c.i < first {
+			return nil, nil, &CompactedError{Topic: c.topic, First: first}
+		}
+		if c.i >= c.log.events.Next() {
+			continue
+		}
+		events, err := c.log.events.Events(c.i)
+		if err != nil {
+			return nil, nil, err
+		}
+		next, ok := events[0].(*simpleEvent)
+		if !ok {
+			// events without a sequence number are delivered
+			// immediately.
+			return c, events[0], nil
+		}
+		if event == nil || next.seq < event.seq {
+			cur, event = c, next
+		}
+	}
+	if cur == nil {
+		return nil, nil, nil
+	}
+	return cur, event, nil
+}
@@ -0,0 +1,143 @@
+package room
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestBusTopics(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	b.EventOn("state", String("state 0"))
+	b.EventOn("cursor", String("cursor 0"))
+	b.Event(String("default 0"))
+	b.EventOn("cursor", String("cursor 1"))
+	b.EventOn("state", String("state 1"))
+
+	s := b.Subscribe(0)
+	if !s.Next(time.After(time.Second)) {
+		t.Fatalf("no event: %v", s.Err())
+	}
+	if s.Event().Topic() != "" || s.Event().Index() != 0 {
+		t.Errorf("event: %q %d", s.Event().Topic(), s.Event().Index())
+	}
+	b.Unsubscribe(s)
+
+	// events from multiple topics are received in the order they were
+	// broadcast, each carrying the index in its own topic.
+	s = b.Subscribe(0, "state", "cursor")
+	defer b.Unsubscribe(s)
+	for _, expect := range []string{"state 0", "cursor 0", "cursor 1", "state 1"} {
+		if !s.Next(time.After(time.Second)) {
+			t.Fatalf("no event %q: %v", expect, s.Err())
+		}
+		if s.Event().Text() != expect {
+			t.Errorf("event: %q (!= %q)", s.Event().Text(), expect)
+		}
+	}
+	if s.Event().Topic() != "state" || s.Event().Index() != 1 {
+		t.Errorf("event: %q %d", s.Event().Topic(), s.Event().Index())
+	}
+}
+
+func TestHTTPBusEventsTopics(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	b.EventOn("state", String("state 0"))
+	b.EventOn("cursor", String("cursor 0"))
+	b.EventOn("state", String("state 1"))
+	b.EventOn("cursor", String("cursor 1"))
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/rex/v0/events?topic=state&start=1&topic=cursor&start=0")
+	if err != nil {
+		t.Fatalf("http: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: %s", resp.Status)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for _, expect := range []string{"cursor 0", "state 1", "cursor 1"} {
+		e := map[string]interface{}{}
+		err := dec.Decode(&e)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if e["data"] != expect {
+			t.Errorf("event: %v (!= %q)", e, expect)
+		}
+	}
+}
+
+func TestBusUnknownTopic(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+
+	s := b.Subscribe(0, "chat")
+	defer b.Unsubscribe(s)
+	b.eventsrdy.L.Lock()
+	_, ok := b.logs["chat"]
+	b.eventsrdy.L.Unlock()
+	if ok {
+		t.Errorf("subscribing allocated a log")
+	}
+
+	// the subscription receives events once the topic is used.
+	b.EventOn("chat", String("hello"))
+	if !s.Next(time.After(time.Second)) {
+		t.Fatalf("no event: %v", s.Err())
+	}
+	if s.Event().Topic() != "chat" || s.Event().Text() != "hello" {
+		t.Errorf("event: %q %q", s.Event().Topic(), s.Event().Text())
+	}
+}
+
+func TestBusTopicStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rex-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := &BusConfig{
+		TopicStore: func(topic string) (EventStore, error) {
+			return OpenFileStore(filepath.Join(dir, topic+".log"))
+		},
+	}
+
+	b := NewBusConfig(context.Background(), config)
+	b.EventOn("state", String("state 0"))
+	b.EventOn("state", String("state 1"))
+	err = b.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	b = NewBusConfig(context.Background(), config)
+	defer b.close()
+	s := b.Subscribe(1, "state")
+	defer b.Unsubscribe(s)
+	b.EventOn("state", String("state 2"))
+	for _, expect := range []string{"state 1", "state 2"} {
+		if !s.Next(time.After(time.Second)) {
+			t.Fatalf("no event %q: %v", expect, s.Err())
+		}
+		if s.Event().Text() != expect {
+			t.Errorf("event: %q (!= %q)", s.Event().Text(), expect)
+		}
+	}
+	if s.Event().Index() != 2 {
+		t.Errorf("index: %d", s.Event().Index())
+	}
+}
@@ -0,0 +1,236 @@
+package room
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// Transport selects the protocol a Client uses to communicate with a server.
+type Transport int
+
+// Transports available to a Client.
+const (
+	// TransportHTTP streams events using chunked HTTP responses and sends
+	// each message in its own POST request.
+	TransportHTTP Transport = iota
+
+	// TransportWebSocket carries both events and messages over a single
+	// WebSocket connection to /rex/v0/ws.  Messages sent while the
+	// connection is not open are delivered using HTTP.
+	TransportWebSocket
+)
+
+// busWebSocketHandler carries events from b and messages to b over a single
+// WebSocket.  Frames sent to the client are event objects and frames received
+// from the client are message objects, both using the same encoding as the
+// HTTP endpoints.  If auth requires tokens the connection must present one and
+// messages are only accepted for the session it was issued to.
+func busWebSocketHandler(b *Bus, auth *joinAuth, origins *originPolicy) http.Handler {
+	return websocket.Server{
+		// Browsers do not restrict cross-origin WebSockets as they do HTTP
+		// requests, so any web page could otherwise drive a session.  Native
+		// clients which send no Origin header are accepted.
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if origin := r.Header.Get("Origin"); origin != "" && !origins.allowed(r, origin) {
+				return errors.New("origin not allowed")
+			}
+			session, ok := auth.session(r)
+			if !ok {
+				return errors.New("a valid session token is required")
+			}
+			if auth.required() && r.URL.Query().Get("session") != session {
+				return errors.New("the session token was issued for a different session")
+			}
+			if b.bans.banned(remoteHost(r), "", time.Now()) {
+				return ErrSessionBanned
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			starts, err := queryStarts(ws.Request())
+			if err != nil {
+				websocket.Message.Send(ws, jsonError("parameter_invalid", "invalid start index"))
+				return
+			}
+
+			session := ws.Request().URL.Query().Get("session")
+			if _, ok := starts[PrivateTopic]; ok && !auth.owns(ws.Request(), session) {
+				websocket.Message.Send(ws, jsonError("session_unauthorized", "a session token is required to receive private events"))
+				return
+			}
+			b.sessions.seenFrom(session, remoteHost(ws.Request()))
+			sub := b.SubscribeTopics(session, starts)
+			defer b.Unsubscribe(sub)
+			if err, ok := sub.Err().(*CompactedError); ok {
+				websocket.Message.Send(ws, jsonCompacted(err))
+				return
+			}
+			if sub.Err() == ErrSessionKicked {
+				websocket.Message.Send(ws, jsonKicked())
+				return
+			}
+
+			// stop is closed when the client disconnects to terminate the
+			// event loop.
+			stop := make(chan time.Time)
+			go func() {
+				defer close(stop)
+				wsReceiveMessages(b, auth, ws)
+			}()
+
+			for sub.Next(stop) {
+				err := websocket.JSON.Send(ws, newJSONEvent(sub.Event()))
+				if err != nil {
+					log.Printf("[INFO] Failed to deliver event to client: %v", err)
+					return
+				}
+			}
+			if frame := jsonTerminated(sub.Err()); frame != "" {
+				websocket.Message.Send(ws, frame)
+			}
+		},
+	}
+}
+
+// wsReceiveMessages passes messages received over ws to b until ws is closed.
+// If auth requires tokens messages from sessions other than the one authorized
+// by the connection's token are dropped.
+func wsReceiveMessages(b *Bus, auth *joinAuth, ws *websocket.Conn) {
+	session, _ := auth.session(ws.Request())
+	for {
+		msg := newJSONMsg(nil)
+		err := websocket.JSON.Receive(ws, msg)
+		if err != nil {
+			return
+		}
+		if auth.required() && msg.S != session {
+			log.Printf("[INFO] Dropped message for unauthorized session %q", msg.S)
+			continue
+		}
+		if msg.R != "" {
+			go wsCall(b, ws, msg)
+			continue
+		}
+		err = b.Deliver(context.Background(), &Delivery{
+			Topic:   msg.P,
+			Session: msg.S,
+			Content: msg.content(),
+			Time:    msg.T,
+			ID:      msg.I,
+		})
+		if err == ErrSessionKicked || err == ErrClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("[INFO] Dropped message from session %q: %v", msg.S, err)
+		}
+	}
+}
+
+func (c *Client) wsURL(pathquery string) string {
+	return "ws" + c.url(pathquery)[len("http"):]
+}
+
+// runWebSocket processes events received over a WebSocket connection until
+// the connection fails or ctx is cancelled, updating next as events are
+// processed.  While the connection is open c.Send delivers messages over it.
+// If live is not nil it is called once the connection is open.
+func (c *Client) runWebSocket(ctx context.Context, next map[string]int, live func()) error {
+	config, err := websocket.NewConfig(c.wsURL(c.eventsPathQuery("/rex/v0/ws", next)), c.url("/"))
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		config.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return err
+	}
+	c.wsmut.Lock()
+	c.ws = ws
+	c.wsmut.Unlock()
+	if live != nil {
+		live()
+	}
+	defer func() {
+		c.wsmut.Lock()
+		c.ws = nil
+		c.wsmut.Unlock()
+		ws.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		var frame []byte
+		err := websocket.Message.Receive(ws, &frame)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if err != nil {
+			return err
+		}
+		if reply, ok := decodeReplyFrame(frame); ok {
+			c.wsReply(reply)
+			continue
+		}
+		var ejs *jsonEvent
+		ejs, err = decodeEventFrame(frame)
+		if err != nil {
+			return err
+		}
+		c.observe(ejs.Event.Time())
+		if c.Handler != nil {
+			c.Handler.HandleEvent(ctx, c, ejs.Event)
+		}
+		next[ejs.Event.Topic()] = int(ejs.Event.Index()) + 1
+	}
+}
+
+// decodeEventFrame decodes a frame sent by the server, which contains either
+// an event or an error object.
+func decodeEventFrame(frame []byte) (*jsonEvent, error) {
+	var jerr jsonErrorBody
+	err := json.Unmarshal(frame, &jerr)
+	if err != nil {
+		return nil, err
+	}
+	if jerr.ID != "" {
+		return nil, jerr.err()
+	}
+	ejs := newJSONEvent(nil)
+	err = json.Unmarshal(frame, ejs)
+	if err != nil {
+		return nil, err
+	}
+	return ejs, nil
+}
+
+// wsSend sends m over the client's WebSocket connection.  If the client does
+// not have an open connection wsSend returns false.
+func (c *Client) wsSend(m *jsonMsg) (ok bool, err error) {
+	c.wsmut.Lock()
+	defer c.wsmut.Unlock()
+	if c.ws == nil {
+		return false, nil
+	}
+	return true, websocket.JSON.Send(c.ws, m)
+}
@@ -0,0 +1,125 @@
+package room
+
+import (
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/websocket"
+)
+
+// testClient returns a client connected to s.
+func testClient(t *testing.T, s *httptest.Server, h EventHandler) *Client {
+	host, port, err := net.SplitHostPort(s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(h)
+	c.Host = host
+	c.Port, err = strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestWebSocket(t *testing.T) {
+	msgs := make(chan Msg, 1)
+	b := NewBus(context.Background(), hfunc(func(ctx context.Context, msg Msg) {
+		msgs <- msg
+	}))
+	defer b.close()
+	b.Event(String("first content"))
+
+	s := httptest.NewServer(newBusHandler(b))
+	defer s.Close()
+
+	events := make(chan Event, 1)
+	c := testClient(t, s, ehfunc(func(ctx context.Context, c *Client, event Event) {
+		events <- event
+	}))
+	c.Transport = TransportWebSocket
+	c.Session = "session-01"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan int)
+	go func() {
+		next, err := c.Run(ctx, 0)
+		if err != nil {
+			t.Errorf("run: %v", err)
+		}
+		done <- next
+	}()
+
+	select {
+	case event := <-events:
+		if event.Index() != 0 || event.Text() != "first content" {
+			t.Errorf("event: %d %q", event.Index(), event.Text())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout receiving event")
+	}
+
+	err := c.Send(ctx, String("test message"))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case msg := <-msgs:
+		if msg.Session() != "session-01" || msg.Text() != "test message" {
+			t.Errorf("message: %q %q", msg.Session(), msg.Text())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout receiving message")
+	}
+
+	b.Event(String("second content"))
+	select {
+	case event := <-events:
+		if event.Index() != 1 || event.Text() != "second content" {
+			t.Errorf("event: %d %q", event.Index(), event.Text())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout receiving event")
+	}
+
+	cancel()
+	select {
+	case next := <-done:
+		if next != 2 {
+			t.Errorf("next: %d", next)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout terminating client")
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	b := NewBus(context.Background())
+	defer b.close()
+	origins := newOriginPolicy([]string{"http://guest.example:8080"})
+	s := httptest.NewServer(newHTTPBus(b, nil, origins))
+	defer s.Close()
+
+	url := "ws" + s.URL[len("http"):] + "/rex/v0/ws?session=session-01"
+	for _, test := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{s.URL, true},
+		{"http://guest.example:8080", true},
+		{"http://evil.example", false},
+	} {
+		ws, err := websocket.Dial(url, "", test.origin)
+		if err == nil {
+			ws.Close()
+		}
+		if (err == nil) != test.allowed {
+			t.Errorf("%s: %v", test.origin, err)
+		}
+	}
+}